@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var adminToken = ""
+
+func init() {
+	if token, ok := os.LookupEnv("APP_ADMIN_TOKEN"); ok {
+		adminToken = token
+	}
+}
+
+func adminRoutes(r *gin.Engine) *gin.RouterGroup {
+	return r.Group("/admin", adminAuthMiddleware)
+}
+
+// adminAuthMiddleware only lets through requests carrying the configured admin bearer
+// token. The admin API is disabled when no token is configured.
+func adminAuthMiddleware(c *gin.Context) {
+	if adminToken == "" {
+		err := errors.New("admin api is disabled")
+		c.AbortWithError(http.StatusForbidden, err)
+		panic(err)
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		err := errors.New("invalid admin token")
+		c.AbortWithError(http.StatusUnauthorized, err)
+		panic(err)
+	}
+	c.Next()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// trustedProxies holds the addresses of the reverse proxies in front of the gateway,
+// the only peers whose X-Forwarded-For header is believed.
+var trustedProxies = map[string]bool{}
+
+var untrustedForwardWarning sync.Once
+
+func init() {
+	if value, ok := os.LookupEnv("APP_TRUSTED_PROXIES"); ok {
+		for _, item := range splitQueryList(value) {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				log.Fatalf("APP_TRUSTED_PROXIES: invalid address '%s'", item)
+			}
+			trustedProxies[ip.String()] = true
+		}
+	}
+}
+
+// clientAddress returns the IP address of the client. Unlike gin's ClientIP it only
+// follows X-Forwarded-For through the configured proxies, from the right, so a client
+// can't pick its own address.
+func clientAddress(c *gin.Context) string {
+	addr, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		addr = c.Request.RemoteAddr
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	if len(trustedProxies) == 0 && c.GetHeader("X-Forwarded-For") != "" {
+		untrustedForwardWarning.Do(func() {
+			log.Printf("X-Forwarded-For from %s ignored: set APP_TRUSTED_PROXIES behind a load balancer, or every client shares its address", addr)
+		})
+	}
+	hops := strings.Split(strings.Join(c.Request.Header["X-Forwarded-For"], ","), ",")
+	for idx := len(hops) - 1; idx >= 0 && trustedProxies[addr]; idx-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[idx]))
+		if ip == nil {
+			break
+		}
+		addr = ip.String()
+	}
+	return addr
+}
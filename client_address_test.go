@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.undefinedlabs.com/scopeagent"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	addressOf := func(remoteAddr string, forwardedFor string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		c.Request.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			c.Request.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return clientAddress(c)
+	}
+
+	test.Run("untrusted", func(t *testing.T) {
+		if addr := addressOf("203.0.113.7:4321", "198.51.100.1"); addr != "203.0.113.7" {
+			t.Fatalf("forwarded address believed: %s", addr)
+		}
+	})
+
+	test.Run("trusted-proxy", func(t *testing.T) {
+		trustedProxies["10.0.0.1"] = true
+		trustedProxies["10.0.0.2"] = true
+		defer func() {
+			delete(trustedProxies, "10.0.0.1")
+			delete(trustedProxies, "10.0.0.2")
+		}()
+		if addr := addressOf("10.0.0.1:80", "198.51.100.9, 203.0.113.7, 10.0.0.2"); addr != "203.0.113.7" {
+			t.Fatalf("unexpected address: %s", addr)
+		}
+		if addr := addressOf("10.0.0.1:80", ""); addr != "10.0.0.1" {
+			t.Fatalf("unexpected address: %s", addr)
+		}
+	})
+}
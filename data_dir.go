@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dataDir holds the files of the stores the gateway keeps its own data in, the data
+// directory under the working directory unless set with APP_DATA_DIR.
+var dataDir = "data"
+
+func init() {
+	if dir, ok := os.LookupEnv("APP_DATA_DIR"); ok && dir != "" {
+		dataDir = dir
+	}
+}
+
+// openDataStores loads every store from its file in dir, creating dir when needed.
+func openDataStores(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	stores := []struct {
+		file string
+		open func(path string) error
+	}{
+		{"image-cleanup.json", func(path string) (err error) {
+			imageCleanup, err = newImageCleanupOutbox(path)
+			return err
+		}},
+		{"trash.json", func(path string) (err error) {
+			trash, err = newRestaurantTrash(path)
+			return err
+		}},
+		{"slugs.json", func(path string) (err error) {
+			slugs, err = newSlugStore(path)
+			return err
+		}},
+		{"webhooks.json", func(path string) (err error) {
+			webhooks, err = newWebhookStore(path)
+			return err
+		}},
+		{"ratings.json", func(path string) (err error) {
+			ratings, err = newRatingLedger(path)
+			return err
+		}},
+		{"reviews.json", func(path string) (err error) {
+			reviews, err = newReviewStore(path)
+			return err
+		}},
+		{"rating-quarantine.json", func(path string) (err error) {
+			ratingGuards, err = newRatingGuard(path)
+			return err
+		}},
+		{"rating-history.jsonl", func(path string) (err error) {
+			ratingHistory, err = newRatingSeries(path)
+			return err
+		}},
+		{"favorites.json", func(path string) (err error) {
+			favorites, err = newFavoriteStore(path)
+			return err
+		}},
+		{"tags.json", func(path string) (err error) {
+			tags, err = newTagStore(path)
+			return err
+		}},
+	}
+	for _, store := range stores {
+		if err := store.open(filepath.Join(dir, store.file)); err != nil {
+			return fmt.Errorf("%s: %v", store.file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventRestaurantCreated  = "restaurant.created"
+	eventRestaurantUpdated  = "restaurant.updated"
+	eventRestaurantDeleted  = "restaurant.deleted"
+	eventRestaurantRestored = "restaurant.restored"
+	eventImageAdded         = "image.added"
+	eventImageDeleted       = "image.deleted"
+	eventRatingAdded        = "rating.added"
+	eventRatingUpdated      = "rating.updated"
+	eventRatingDeleted      = "rating.deleted"
+
+	eventsPath             = "/events"
+	eventSubscriberBacklog = 64
+)
+
+type (
+	event struct {
+		Id           int64       `json:"id"`
+		Type         string      `json:"type"`
+		RestaurantId string      `json:"restaurantId,omitempty"`
+		Time         time.Time   `json:"time"`
+		Data         interface{} `json:"data,omitempty"`
+	}
+
+	// eventBroker fans out the changes made through the gateway to the connected
+	// subscribers, keeping the latest events in a ring buffer so that a subscriber
+	// that reconnects can pick up where it left off.
+	eventBroker struct {
+		sync.Mutex
+		lastId      int64
+		ring        []event
+		next        int
+		size        int
+		subscribers map[chan event]bool
+		listeners   []func(event)
+	}
+
+	// eventFilter selects events by restaurant and by type. A type without a dot, like
+	// "image", selects the whole topic.
+	eventFilter struct {
+		restaurants map[string]bool
+		types       map[string]bool
+	}
+)
+
+var (
+	eventsHeartbeat = 15 * time.Second
+	events          *eventBroker
+)
+
+func init() {
+	size := 1000
+	if value, ok := os.LookupEnv("APP_EVENTS_BUFFER"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			log.Fatalf("APP_EVENTS_BUFFER: invalid size '%s'", value)
+		}
+		size = n
+	}
+	// ids continue from the startup time in microseconds, so they keep growing across
+	// restarts and a reconnecting client's Last-Event-ID never runs ahead of them
+	events = newEventBroker(size, time.Now().UnixNano()/int64(time.Microsecond))
+}
+
+func newEventBroker(size int, lastId int64) *eventBroker {
+	return &eventBroker{lastId: lastId, ring: make([]event, size), subscribers: map[chan event]bool{}}
+}
+
+func addEventEndpoints(r *gin.Engine) {
+	r.GET(eventsPath, getEvents)
+}
+
+func getEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := parseEventFilter(c)
+	// EventSource can only send Last-Event-ID when it reconnects by itself
+	lastEventId := c.GetHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.Query("lastEventId")
+	}
+	after := int64(-1)
+	if lastEventId != "" {
+		id, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || id < 0 {
+			err = errors.New("invalid Last-Event-ID")
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		after = id
+	}
+
+	sub, missed := events.subscribe(after)
+	defer events.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", 3000)
+	for _, e := range missed {
+		if filter.matches(e) {
+			if err := writeEvent(c, e); err != nil {
+				return
+			}
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub:
+			if !ok {
+				// the subscriber fell behind, it will resume from the ring buffer
+				return
+			}
+			if !filter.matches(e) {
+				continue
+			}
+			if err := writeEvent(c, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(c *gin.Context, e event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+	return err
+}
+
+func parseEventFilter(c *gin.Context) eventFilter {
+	var filter eventFilter
+	if q := c.Query("restaurantId"); q != "" {
+		filter.restaurants = map[string]bool{}
+		for _, item := range splitQueryList(q) {
+			filter.restaurants[item] = true
+		}
+	}
+	if q := c.Query("type"); q != "" {
+		filter.types = map[string]bool{}
+		for _, item := range splitQueryList(q) {
+			filter.types[item] = true
+		}
+	}
+	return filter
+}
+
+func (f eventFilter) matches(e event) bool {
+	if f.restaurants != nil && !f.restaurants[e.RestaurantId] {
+		return false
+	}
+	if f.types != nil && !f.types[e.Type] {
+		topic := strings.SplitN(e.Type, ".", 2)[0]
+		return f.types[topic]
+	}
+	return true
+}
+
+func (b *eventBroker) publish(eventType string, restaurantId string, data interface{}) {
+	e := b.record(eventType, restaurantId, data)
+	for _, listen := range b.listeners {
+		listen(e)
+	}
+}
+
+// listen registers a function called with every published event, from the publishing
+// goroutine. It must be called before anything is published.
+func (b *eventBroker) listen(f func(event)) {
+	b.listeners = append(b.listeners, f)
+}
+
+func (b *eventBroker) record(eventType string, restaurantId string, data interface{}) event {
+	b.Lock()
+	defer b.Unlock()
+	b.lastId++
+	e := event{Id: b.lastId, Type: eventType, RestaurantId: restaurantId, Time: time.Now().UTC(), Data: data}
+	b.ring[b.next] = e
+	b.next = (b.next + 1) % len(b.ring)
+	if b.size < len(b.ring) {
+		b.size++
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub <- e:
+		default:
+			// don't let a slow subscriber hold up the handlers
+			delete(b.subscribers, sub)
+			close(sub)
+		}
+	}
+	return e
+}
+
+// subscribe registers a new subscriber and returns the buffered events after the
+// given id, so that none is lost between the replay and the live stream.
+func (b *eventBroker) subscribe(after int64) (chan event, []event) {
+	b.Lock()
+	defer b.Unlock()
+	sub := make(chan event, eventSubscriberBacklog)
+	b.subscribers[sub] = true
+	if after < 0 {
+		return sub, nil
+	}
+	var missed []event
+	for i := 0; i < b.size; i++ {
+		e := b.ring[(b.next-b.size+i+len(b.ring))%len(b.ring)]
+		if e.Id > after {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed
+}
+
+func (b *eventBroker) unsubscribe(sub chan event) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub)
+	}
+}
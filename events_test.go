@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"go.undefinedlabs.com/scopeagent"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("replay", func(t *testing.T) {
+		broker := newEventBroker(3, 0)
+		for i := 0; i < 5; i++ {
+			broker.publish(eventRestaurantUpdated, "1", nil)
+		}
+		sub, missed := broker.subscribe(2)
+		defer broker.unsubscribe(sub)
+		if len(missed) != 3 || missed[0].Id != 3 || missed[2].Id != 5 {
+			t.Fatalf("unexpected replay: %v", missed)
+		}
+		broker.publish(eventRatingAdded, "1", nil)
+		if e := <-sub; e.Id != 6 || e.Type != eventRatingAdded {
+			t.Fatalf("unexpected live event: %v", e)
+		}
+	})
+
+	test.Run("restart", func(t *testing.T) {
+		before := newEventBroker(3, time.Now().UnixNano()/int64(time.Microsecond))
+		last := before.record(eventRestaurantUpdated, "1", nil)
+		time.Sleep(time.Millisecond)
+		after := newEventBroker(3, time.Now().UnixNano()/int64(time.Microsecond))
+		sub, _ := after.subscribe(last.Id)
+		defer after.unsubscribe(sub)
+		after.publish(eventRatingAdded, "1", nil)
+		if e := <-sub; e.Id <= last.Id {
+			t.Fatalf("event id %d not after %d", e.Id, last.Id)
+		}
+	})
+
+	test.Run("slow-subscriber", func(t *testing.T) {
+		broker := newEventBroker(10, 0)
+		sub, _ := broker.subscribe(-1)
+		for i := 0; i < eventSubscriberBacklog+1; i++ {
+			broker.publish(eventRestaurantCreated, "1", nil)
+		}
+		for range sub {
+		}
+		broker.unsubscribe(sub)
+	})
+
+	test.Run("filter", func(t *testing.T) {
+		filter := eventFilter{restaurants: map[string]bool{"1": true}, types: map[string]bool{"image": true, eventRatingAdded: true}}
+		for _, c := range []struct {
+			e     event
+			match bool
+		}{
+			{event{Type: eventImageAdded, RestaurantId: "1"}, true},
+			{event{Type: eventRatingAdded, RestaurantId: "1"}, true},
+			{event{Type: eventRestaurantUpdated, RestaurantId: "1"}, false},
+			{event{Type: eventImageAdded, RestaurantId: "2"}, false},
+		} {
+			if filter.matches(c.e) != c.match {
+				t.Fatalf("unexpected match for %v", c.e)
+			}
+		}
+	})
+
+	test.Run("stream", func(t *testing.T) {
+		events.publish(eventRestaurantDeleted, "events-test", nil)
+
+		ctx, cancel := context.WithTimeout(scopeagent.GetContextFromTest(t), 200*time.Millisecond)
+		defer cancel()
+		url := "/events?restaurantId=events-test"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		req.Header.Set("Last-Event-ID", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected response: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		if body := w.Body.String(); !strings.Contains(body, "event: "+eventRestaurantDeleted) {
+			t.Fatalf("missed event not replayed: %s", body)
+		}
+	})
+}
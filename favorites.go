@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// favoriteStore keeps the restaurants each user saved, by user id.
+	favoriteStore struct {
+		sync.Mutex
+		path  string
+		users map[string][]favorite
+	}
+
+	favorite struct {
+		RestaurantId string    `json:"restaurantId"`
+		AddedAt      time.Time `json:"addedAt"`
+	}
+)
+
+var favorites *favoriteStore
+
+func newFavoriteStore(path string) (*favoriteStore, error) {
+	store := &favoriteStore{path: path, users: map[string][]favorite{}}
+	if err := readJsonFile(path, &store.users); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func addFavoriteEndpoints(r *gin.Engine) {
+	r.GET("/me/favorites", getFavorites)
+	r.GET("/me/favorites/:restaurantId", getFavorite)
+	r.PUT("/me/favorites/:restaurantId", putFavorite)
+	r.DELETE("/me/favorites/:restaurantId", deleteFavorite)
+}
+
+// getFavorites returns the restaurants the user saved, most recently saved first, with
+// the same fields and embeds as GET /restaurants.
+func getFavorites(c *gin.Context) {
+	userId := signedInUser(c)
+	view, err := parseRestaurantView(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	saved := favorites.list(userId)
+	if len(saved) == 0 {
+		c.JSON(http.StatusOK, []restaurant{})
+		return
+	}
+	all, err := GetAllRestaurants(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	byId := map[string]restaurantApi{}
+	for _, item := range trash.filter(all) {
+		byId[item.Id] = item
+	}
+	r := make([]restaurantApi, 0, len(saved))
+	for _, item := range saved {
+		// restaurants deleted behind the gateway's back are skipped
+		if rest, ok := byId[item.RestaurantId]; ok {
+			r = append(r, rest)
+		}
+	}
+	body, err := view.renderAll(lookupRestaurants(c, r, view))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+func getFavorite(c *gin.Context) {
+	userId := signedInUser(c)
+	restaurantId := c.Param("restaurantId")
+	abortIfTrashed(c, restaurantId)
+	item, ok := favorites.get(userId, restaurantId)
+	if !ok {
+		err := errors.New("restaurant is not a favorite")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+func putFavorite(c *gin.Context) {
+	userId := signedInUser(c)
+	restaurantId := c.Param("restaurantId")
+	requireRestaurant(c, restaurantId)
+	if err := favorites.add(userId, restaurantId); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteFavorite(c *gin.Context) {
+	userId := signedInUser(c)
+	if err := favorites.remove(userId, c.Param("restaurantId")); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// list returns the favorites of a user, most recently saved first.
+func (s *favoriteStore) list(userId string) []favorite {
+	s.Lock()
+	defer s.Unlock()
+	items := s.users[userId]
+	list := make([]favorite, 0, len(items))
+	for idx := len(items) - 1; idx >= 0; idx-- {
+		list = append(list, items[idx])
+	}
+	return list
+}
+
+func (s *favoriteStore) get(userId string, restaurantId string) (favorite, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range s.users[userId] {
+		if item.RestaurantId == restaurantId {
+			return item, true
+		}
+	}
+	return favorite{}, false
+}
+
+// add saves a restaurant for a user, keeping the time it was first saved.
+func (s *favoriteStore) add(userId string, restaurantId string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range s.users[userId] {
+		if item.RestaurantId == restaurantId {
+			return nil
+		}
+	}
+	s.users[userId] = append(s.users[userId], favorite{RestaurantId: restaurantId, AddedAt: time.Now().UTC()})
+	return writeJsonFile(s.path, s.users)
+}
+
+func (s *favoriteStore) remove(userId string, restaurantId string) error {
+	s.Lock()
+	defer s.Unlock()
+	items := s.users[userId]
+	for idx, item := range items {
+		if item.RestaurantId == restaurantId {
+			s.users[userId] = append(items[:idx], items[idx+1:]...)
+			if len(s.users[userId]) == 0 {
+				delete(s.users, userId)
+			}
+			return writeJsonFile(s.path, s.users)
+		}
+	}
+	return nil
+}
+
+// removeRestaurant drops a deleted restaurant from the favorites of every user.
+func (s *favoriteStore) removeRestaurant(restaurantId string) {
+	s.Lock()
+	defer s.Unlock()
+	changed := false
+	for userId, items := range s.users {
+		kept := items[:0]
+		for _, item := range items {
+			if item.RestaurantId != restaurantId {
+				kept = append(kept, item)
+			}
+		}
+		if len(kept) == len(items) {
+			continue
+		}
+		changed = true
+		if len(kept) == 0 {
+			delete(s.users, userId)
+		} else {
+			s.users[userId] = kept
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := writeJsonFile(s.path, s.users); err != nil {
+		log.Printf("favorite store: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFavorites(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("store", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "favorites")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "favorites.json")
+
+		store, err := newFavoriteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, restaurantId := range []string{"1", "2", "1", "3"} {
+			if err := store.add("alice", restaurantId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.add("bob", "2"); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := newFavoriteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := reloaded.list("alice")
+		if len(list) != 3 || list[0].RestaurantId != "3" || list[2].RestaurantId != "1" {
+			t.Fatalf("unexpected favorites: %+v", list)
+		}
+
+		reloaded.removeRestaurant("2")
+		if len(reloaded.list("alice")) != 2 || len(reloaded.list("bob")) != 0 {
+			t.Fatal("deleted restaurant kept in the favorites")
+		}
+		if err := reloaded.remove("alice", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reloaded.get("alice", "1"); ok {
+			t.Fatal("favorite not removed")
+		}
+	})
+
+	test.Run("put-get-delete", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/me/favorites/" + restaurantId
+		for _, step := range []struct {
+			method string
+			status int
+		}{
+			{"PUT", http.StatusNoContent},
+			{"GET", http.StatusOK},
+			{"DELETE", http.StatusNoContent},
+			{"GET", http.StatusNotFound},
+		} {
+			req, _ := http.NewRequestWithContext(ctx, step.method, url, nil)
+			req.Header.Set("Authorization", "Bearer "+userToken("favorites-test-user"))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			res := w.Result()
+
+			if res.StatusCode != step.status {
+				t.Fatalf("server: %s %s respond: %d: %s", step.method, url, res.StatusCode, res.Status)
+			}
+		}
+	})
+
+	test.Run("unknown-restaurant", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/me/favorites/00000000-0000-0000-0000-000000000000"
+		req, _ := http.NewRequestWithContext(ctx, "PUT", url, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken("favorites-test-user"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+
+	test.Run("signed-out", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/me/favorites"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
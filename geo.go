@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// restaurantCoordinates parses the latitude and longitude the restaurant service keeps
+// as strings.
+func restaurantCoordinates(r restaurantApi) (float64, float64, bool) {
+	if r.Latitude == nil || r.Longitude == nil {
+		return 0, 0, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(*r.Latitude), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(*r.Longitude), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+func validCoordinates(r restaurantApi) bool {
+	lat, lng, ok := restaurantCoordinates(r)
+	return ok && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+type (
+	idempotencyRecord struct {
+		RequestHash string    `json:"requestHash"`
+		Completed   bool      `json:"completed"`
+		Status      int       `json:"status"`
+		ContentType string    `json:"contentType"`
+		Body        []byte    `json:"body"`
+		CreatedAt   time.Time `json:"createdAt"`
+	}
+
+	// idempotencyStore keeps the first response sent for every Idempotency-Key.
+	idempotencyStore interface {
+		// reserve returns the record already stored for key, or reserves the key for
+		// a new request when there is none.
+		reserve(key string, requestHash string) (*idempotencyRecord, error)
+		complete(key string, record idempotencyRecord) error
+		release(key string) error
+	}
+
+	memoryIdempotencyStore struct {
+		sync.Mutex
+		ttl       time.Duration
+		records   map[string]*idempotencyRecord
+		lastPurge time.Time
+	}
+
+	fileIdempotencyStore struct {
+		*memoryIdempotencyStore
+		path string
+	}
+
+	idempotencyResponseWriter struct {
+		gin.ResponseWriter
+		body bytes.Buffer
+	}
+)
+
+var (
+	idempotencyTTL  = 24 * time.Hour
+	idempotencyKeys idempotencyStore
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_IDEMPOTENCY_TTL"); ok {
+		if ttl, err := time.ParseDuration(value); err == nil {
+			idempotencyTTL = ttl
+		}
+	}
+	if path, ok := os.LookupEnv("APP_IDEMPOTENCY_FILE"); ok {
+		store, err := newFileIdempotencyStore(path, idempotencyTTL)
+		if err != nil {
+			log.Fatalf("idempotency store: %v", err)
+		}
+		idempotencyKeys = store
+	} else {
+		idempotencyKeys = newMemoryIdempotencyStore(idempotencyTTL)
+	}
+}
+
+func newMemoryIdempotencyStore(ttl time.Duration) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, records: map[string]*idempotencyRecord{}}
+}
+
+func newFileIdempotencyStore(path string, ttl time.Duration) (*fileIdempotencyStore, error) {
+	store := &fileIdempotencyStore{memoryIdempotencyStore: newMemoryIdempotencyStore(ttl), path: path}
+	if err := readJsonFile(path, &store.records); err != nil {
+		return nil, err
+	}
+	for key, record := range store.records {
+		if !record.Completed {
+			delete(store.records, key)
+		}
+	}
+	return store, nil
+}
+
+// idempotencyMiddleware replays the stored response when a request is retried with the
+// same Idempotency-Key, and rejects keys reused for a different request with 422. Keys
+// are scoped to the caller, so two clients picking the same key don't see each other's
+// responses.
+func idempotencyMiddleware(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	key = idempotencyCaller(c) + " " + key
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+	hash.Write(body)
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	record, err := idempotencyKeys.reserve(key, requestHash)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if record != nil {
+		if record.RequestHash != requestHash {
+			err := errors.New("idempotency key was already used for a different request")
+			c.AbortWithError(http.StatusUnprocessableEntity, err)
+			panic(err)
+		}
+		if !record.Completed {
+			err := errors.New("a request with this idempotency key is still in progress")
+			c.AbortWithError(http.StatusConflict, err)
+			panic(err)
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(record.Status, record.ContentType, record.Body)
+		c.Abort()
+		return
+	}
+
+	writer := &idempotencyResponseWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	completed := false
+	defer func() {
+		if !completed {
+			// failed attempts don't claim the key, so the client can retry them
+			if err := idempotencyKeys.release(key); err != nil {
+				logError(c, err)
+			}
+		}
+	}()
+	c.Next()
+
+	if status := writer.Status(); status < http.StatusInternalServerError && !c.IsAborted() {
+		err := idempotencyKeys.complete(key, idempotencyRecord{
+			RequestHash: requestHash,
+			Completed:   true,
+			Status:      status,
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+			CreatedAt:   time.Now(),
+		})
+		if err != nil {
+			logError(c, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// idempotencyCaller identifies who sent a request, by its credentials when it has
+// them and by its address otherwise.
+func idempotencyCaller(c *gin.Context) string {
+	if authorization := c.GetHeader("Authorization"); authorization != "" {
+		sum := sha256.Sum256([]byte(authorization))
+		return "auth:" + hex.EncodeToString(sum[:])
+	}
+	return "addr:" + clientAddress(c)
+}
+
+func (w *idempotencyResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (s *memoryIdempotencyStore) reserve(key string, requestHash string) (*idempotencyRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.purgeLocked()
+	if record, ok := s.records[key]; ok {
+		existing := *record
+		return &existing, nil
+	}
+	s.records[key] = &idempotencyRecord{RequestHash: requestHash, CreatedAt: time.Now()}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) complete(key string, record idempotencyRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records[key] = &record
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) purgeLocked() {
+	now := time.Now()
+	if now.Sub(s.lastPurge) < time.Minute {
+		return
+	}
+	s.lastPurge = now
+	for key, record := range s.records {
+		if now.Sub(record.CreatedAt) > s.ttl {
+			delete(s.records, key)
+		}
+	}
+}
+
+func (s *fileIdempotencyStore) complete(key string, record idempotencyRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records[key] = &record
+	return writeJsonFile(s.path, s.records)
+}
+
+func (s *fileIdempotencyStore) release(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	delete(s.records, key)
+	return writeJsonFile(s.path, s.records)
+}
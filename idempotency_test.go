@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	calls := 0
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.POST("/items", idempotencyMiddleware, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, calls)
+	})
+	post := func(t *testing.T, key string, body string) *http.Response {
+		req, _ := http.NewRequestWithContext(scopeagent.GetContextFromTest(t), "POST", "/items", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	test.Run("replay", func(t *testing.T) {
+		first := post(t, "key-1", "4")
+		second := post(t, "key-1", "4")
+		firstBody, _ := ioutil.ReadAll(first.Body)
+		secondBody, _ := ioutil.ReadAll(second.Body)
+		if calls != 1 {
+			t.Fatalf("handler ran %d times", calls)
+		}
+		if string(firstBody) != string(secondBody) || second.Header.Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("expected a replay of %s, got %s", firstBody, secondBody)
+		}
+	})
+
+	test.Run("different-body", func(t *testing.T) {
+		if res := post(t, "key-1", "5"); res.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d", res.StatusCode)
+		}
+	})
+
+	test.Run("scoped", func(t *testing.T) {
+		send := func(url string, authorization string) *http.Response {
+			req, _ := http.NewRequestWithContext(scopeagent.GetContextFromTest(t), "POST", url, strings.NewReader("4"))
+			req.Header.Set(idempotencyKeyHeader, "key-2")
+			req.Header.Set("Authorization", authorization)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w.Result()
+		}
+		send("/items", "Bearer alice")
+		before := calls
+		if res := send("/items", "Bearer bob"); res.StatusCode != http.StatusOK || res.Header.Get("Idempotent-Replayed") != "" || calls != before+1 {
+			t.Fatal("another caller got the stored response")
+		}
+		if res := send("/items?include=images", "Bearer alice"); res.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422 for a different query, got %d", res.StatusCode)
+		}
+	})
+
+	test.Run("without-key", func(t *testing.T) {
+		before := calls
+		post(t, "", "4")
+		post(t, "", "4")
+		if calls != before+2 {
+			t.Fatal("requests without a key must not be deduplicated")
+		}
+	})
+
+	test.Run("file-store", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "idempotency")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "keys.json")
+
+		store, err := newFileIdempotencyStore(path, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record, _ := store.reserve("key", "hash"); record != nil {
+			t.Fatal("unexpected record for a new key")
+		}
+		if err := store.complete("key", idempotencyRecord{RequestHash: "hash", Completed: true, Status: http.StatusOK, Body: []byte("1"), CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+
+		reloaded, err := newFileIdempotencyStore(path, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, _ := reloaded.reserve("key", "hash")
+		if record == nil || string(record.Body) != "1" {
+			t.Fatalf("record not persisted: %v", record)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	imageCleanupRestaurant = "restaurant"
+	imageCleanupImage      = "image"
+)
+
+type (
+	// imageCleanupOutbox is a file-backed queue of image deletions that failed and
+	// must be retried after the request that started them has ended.
+	imageCleanupOutbox struct {
+		sync.Mutex
+		path  string
+		tasks []*imageCleanupTask
+		wake  chan struct{}
+	}
+
+	imageCleanupTask struct {
+		Id           string    `json:"id"`
+		Kind         string    `json:"kind"`
+		RestaurantId string    `json:"restaurantId"`
+		ImageId      string    `json:"imageId,omitempty"`
+		Attempts     int       `json:"attempts"`
+		LastError    string    `json:"lastError,omitempty"`
+		CreatedAt    time.Time `json:"createdAt"`
+		NextAttempt  time.Time `json:"nextAttempt"`
+	}
+)
+
+var (
+	imageCleanupBaseBackoff = 5 * time.Second
+	imageCleanupMaxBackoff  = 30 * time.Minute
+	imageCleanup            *imageCleanupOutbox
+)
+
+func newImageCleanupOutbox(path string) (*imageCleanupOutbox, error) {
+	outbox := &imageCleanupOutbox{path: path, wake: make(chan struct{}, 1)}
+	if err := readJsonFile(path, &outbox.tasks); err != nil {
+		return nil, err
+	}
+	return outbox, nil
+}
+
+func getImageCleanupTasks(c *gin.Context) {
+	c.JSON(http.StatusOK, imageCleanup.list())
+}
+
+func retryImageCleanupTask(c *gin.Context) {
+	if err := imageCleanup.retryNow(c.Param("taskId")); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// deleteRestaurantImages deletes every image of a restaurant, handing whatever could not
+// be deleted over to the outbox. It only fails when the outbox can't record the work.
+func (o *imageCleanupOutbox) deleteRestaurantImages(ctx context.Context, restaurantId string) error {
+	imgs, err := GetImagesByRestaurant(ctx, restaurantId)
+	if err != nil {
+		return o.enqueue(imageCleanupTask{Kind: imageCleanupRestaurant, RestaurantId: restaurantId, LastError: err.Error()})
+	}
+	for _, imageId := range imgs {
+		if err := deleteImageOf(ctx, restaurantId, imageId); err != nil {
+			if err := o.enqueue(imageCleanupTask{Kind: imageCleanupImage, RestaurantId: restaurantId, ImageId: imageId, LastError: err.Error()}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *imageCleanupOutbox) enqueue(task imageCleanupTask) error {
+	o.Lock()
+	defer o.Unlock()
+	task.Id = newId()
+	task.Attempts = 1
+	task.CreatedAt = time.Now()
+	task.NextAttempt = task.CreatedAt.Add(imageCleanupBackoff(task.Attempts))
+	o.tasks = append(o.tasks, &task)
+	return writeJsonFile(o.path, o.tasks)
+}
+
+func (o *imageCleanupOutbox) list() []imageCleanupTask {
+	o.Lock()
+	defer o.Unlock()
+	tasks := make([]imageCleanupTask, 0, len(o.tasks))
+	for _, task := range o.tasks {
+		tasks = append(tasks, *task)
+	}
+	return tasks
+}
+
+func (o *imageCleanupOutbox) retryNow(taskId string) error {
+	o.Lock()
+	defer o.Unlock()
+	for _, task := range o.tasks {
+		if task.Id == taskId {
+			task.NextAttempt = time.Now()
+			select {
+			case o.wake <- struct{}{}:
+			default:
+			}
+			return writeJsonFile(o.path, o.tasks)
+		}
+	}
+	return errors.New("cleanup task not found")
+}
+
+// run retries the due tasks until ctx is done.
+func (o *imageCleanupOutbox) run(ctx context.Context) {
+	ticker := time.NewTicker(imageCleanupBaseBackoff)
+	defer ticker.Stop()
+	for {
+		o.process(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+func (o *imageCleanupOutbox) process(ctx context.Context) {
+	o.Lock()
+	var due []imageCleanupTask
+	now := time.Now()
+	for _, task := range o.tasks {
+		if !task.NextAttempt.After(now) {
+			due = append(due, *task)
+		}
+	}
+	o.Unlock()
+
+	for _, task := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		var err error
+		var followUps []imageCleanupTask
+		switch task.Kind {
+		case imageCleanupImage:
+			err = deleteImageOf(ctx, task.RestaurantId, task.ImageId)
+		case imageCleanupRestaurant:
+			var imgs []string
+			imgs, err = GetImagesByRestaurant(ctx, task.RestaurantId)
+			for _, imageId := range imgs {
+				if err := deleteImageOf(ctx, task.RestaurantId, imageId); err != nil {
+					followUps = append(followUps, imageCleanupTask{Kind: imageCleanupImage, RestaurantId: task.RestaurantId, ImageId: imageId, LastError: err.Error()})
+				}
+			}
+		}
+		if err := o.complete(task.Id, err, followUps); err != nil {
+			log.Printf("image cleanup outbox: %v", err)
+		}
+	}
+}
+
+// complete records the outcome of an attempt: the task is removed when it succeeded
+// and rescheduled with a longer backoff when it didn't.
+func (o *imageCleanupOutbox) complete(taskId string, attemptErr error, followUps []imageCleanupTask) error {
+	o.Lock()
+	defer o.Unlock()
+	for idx, task := range o.tasks {
+		if task.Id != taskId {
+			continue
+		}
+		if attemptErr == nil {
+			o.tasks = append(o.tasks[:idx], o.tasks[idx+1:]...)
+		} else {
+			task.Attempts++
+			task.LastError = attemptErr.Error()
+			task.NextAttempt = time.Now().Add(imageCleanupBackoff(task.Attempts))
+		}
+		break
+	}
+	now := time.Now()
+	for _, followUp := range followUps {
+		followUp.Id = newId()
+		followUp.Attempts = 1
+		followUp.CreatedAt = now
+		followUp.NextAttempt = now.Add(imageCleanupBackoff(followUp.Attempts))
+		task := followUp
+		o.tasks = append(o.tasks, &task)
+	}
+	return writeJsonFile(o.path, o.tasks)
+}
+
+func imageCleanupBackoff(attempts int) time.Duration {
+	return retryBackoff(imageCleanupBaseBackoff, imageCleanupMaxBackoff, attempts)
+}
+
+// retryBackoff doubles the wait after every failed attempt, up to max.
+func retryBackoff(base, max time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// jitter spreads the retries of a burst of failures
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageCleanupOutbox(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	test.Run("durable", func(t *testing.T) {
+		outbox, err := newImageCleanupOutbox(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := outbox.enqueue(imageCleanupTask{Kind: imageCleanupImage, RestaurantId: restaurantId, ImageId: "img"}); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := newImageCleanupOutbox(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks := reloaded.list()
+		if len(tasks) != 1 || tasks[0].ImageId != "img" || tasks[0].Id == "" {
+			t.Fatalf("unexpected tasks: %v", tasks)
+		}
+
+		if err := reloaded.complete(tasks[0].Id, errors.New("still down"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if tasks := reloaded.list(); tasks[0].Attempts != 2 || !tasks[0].NextAttempt.After(tasks[0].CreatedAt) {
+			t.Fatalf("failed attempt not rescheduled: %v", tasks[0])
+		}
+		if err := reloaded.complete(tasks[0].Id, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if tasks := reloaded.list(); len(tasks) != 0 {
+			t.Fatalf("completed task still queued: %v", tasks)
+		}
+	})
+
+	test.Run("publishes", func(t *testing.T) {
+		images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer images.Close()
+		defer func(url string) { imagesApiUrl = url }(imagesApiUrl)
+		imagesApiUrl = images.URL
+
+		outbox, err := newImageCleanupOutbox(filepath.Join(dir, "publishes.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outbox.tasks = append(outbox.tasks, &imageCleanupTask{Id: "task", Kind: imageCleanupImage, RestaurantId: "cleanup-test", ImageId: "img"})
+		sub, _ := events.subscribe(-1)
+		defer events.unsubscribe(sub)
+		outbox.process(scopeagent.GetContextFromTest(t))
+		if e := <-sub; e.Type != eventImageDeleted || e.RestaurantId != "cleanup-test" {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+		if tasks := outbox.list(); len(tasks) != 0 {
+			t.Fatalf("task still queued: %v", tasks)
+		}
+	})
+
+	test.Run("backoff", func(t *testing.T) {
+		for attempts := 1; attempts < 30; attempts++ {
+			if backoff := imageCleanupBackoff(attempts); backoff <= 0 || backoff > imageCleanupMaxBackoff {
+				t.Fatalf("backoff out of range for %d attempts: %v", attempts, backoff)
+			}
+		}
+	})
+
+	test.Run("admin-disabled", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/admin/image-cleanup"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
@@ -28,6 +28,10 @@ func addImageServiceEndpoints(r *gin.Engine) {
 	r.DELETE("/images/:imageId", deleteImage)
 	r.GET("/restaurants/:restaurantId/images", getRestaurantImages)
 	r.POST("/restaurants/:restaurantId/images", postRestaurantImage)
+	r.DELETE("/restaurants/:restaurantId/images/:imageId", deleteRestaurantImage)
+	admin := adminRoutes(r)
+	admin.GET("/image-cleanup", getImageCleanupTasks)
+	admin.POST("/image-cleanup/:taskId/retry", retryImageCleanupTask)
 }
 
 func getImage(c *gin.Context) {
@@ -41,6 +45,9 @@ func getImage(c *gin.Context) {
 	c.Data(http.StatusOK, cType, body)
 }
 
+// deleteImage deletes an image without knowing its restaurant, so no event is published
+// for it. DELETE /restaurants/:restaurantId/images/:imageId tells the restaurant's
+// followers.
 func deleteImage(c *gin.Context) {
 	ctx := c.Request.Context()
 	imageId := c.Param("imageId")
@@ -52,6 +59,40 @@ func deleteImage(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+func deleteRestaurantImage(c *gin.Context) {
+	ctx := c.Request.Context()
+	restaurantId := c.Param("restaurantId")
+	imageId := c.Param("imageId")
+	imgs, err := GetImagesByRestaurant(ctx, restaurantId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	owned := false
+	for _, item := range imgs {
+		owned = owned || item == imageId
+	}
+	if !owned {
+		err := errors.New("image not found")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if err := deleteImageOf(ctx, restaurantId, imageId); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Status(http.StatusOK)
+}
+
+// deleteImageOf deletes an image of a restaurant and publishes the deletion.
+func deleteImageOf(ctx context.Context, restaurantId string, imageId string) error {
+	if err := DeleteImage(ctx, imageId); err != nil {
+		return err
+	}
+	events.publish(eventImageDeleted, restaurantId, gin.H{"imageId": imageId})
+	return nil
+}
+
 func getRestaurantImages(c *gin.Context) {
 	ctx := c.Request.Context()
 	restaurantId := c.Param("restaurantId")
@@ -73,6 +114,7 @@ func postRestaurantImage(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
+	events.publish(eventImageAdded, restaurantId, gin.H{"imageId": value, "url": fmt.Sprintf("/images/%s", value)})
 
 	c.JSON(http.StatusOK, value)
 }
@@ -136,20 +178,6 @@ func AddImageToRestaurant(ctx context.Context, restaurantId string, contentType
 	return imageId, nil
 }
 
-func DeleteImagesByRestaurant(ctx context.Context, restaurantId string) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	imgs, err := GetImagesByRestaurant(ctx, restaurantId)
-	if err != nil {
-		return err
-	}
-	var lastError error
-	for idx := range imgs {
-		lastError = DeleteImage(ctx, imgs[idx])
-	}
-	return lastError
-}
-
 func GetImage(ctx context.Context, imageId string) (string, []byte, error) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+type jsonPatchOperation struct {
+	Op    string
+	Path  string
+	From  string
+	Value json.RawMessage
+}
+
+// applyMergePatch applies an RFC 7396 merge patch to a JSON document.
+func applyMergePatch(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decodeJsonValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJsonValue(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatchValue(target, p))
+}
+
+func mergePatchValue(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatchValue(t[key], value)
+		}
+	}
+	return t
+}
+
+// decodeJsonPatch parses an RFC 6902 patch document, so malformed patches can be told
+// apart from patches that don't apply to the current document.
+func decodeJsonPatch(patch []byte) ([]jsonPatchOperation, error) {
+	// decoded member by member, as a null value must not be mistaken for a missing one
+	var members []map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil {
+		return nil, err
+	}
+	ops := make([]jsonPatchOperation, len(members))
+	for idx, member := range members {
+		op := &ops[idx]
+		for key, target := range map[string]*string{"op": &op.Op, "path": &op.Path, "from": &op.From} {
+			if raw, ok := member[key]; ok {
+				if err := json.Unmarshal(raw, target); err != nil {
+					return nil, fmt.Errorf("operation %d: invalid '%s': %v", idx, key, err)
+				}
+			}
+		}
+		if _, ok := member["path"]; !ok {
+			return nil, fmt.Errorf("operation %d: missing path", idx)
+		}
+		op.Value = member["value"]
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: '%s' requires a value", idx, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parseJsonPointer(op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: %v", idx, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op '%s'", idx, op.Op)
+		}
+		if _, err := parseJsonPointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", idx, err)
+		}
+	}
+	return ops, nil
+}
+
+// applyJsonPatch applies decoded RFC 6902 operations to a JSON document, atomically.
+func applyJsonPatch(doc []byte, ops []jsonPatchOperation) ([]byte, error) {
+	target, err := decodeJsonValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	for idx, op := range ops {
+		path, _ := parseJsonPointer(op.Path)
+		switch op.Op {
+		case "add":
+			var value interface{}
+			value, err = decodeJsonValue(op.Value)
+			if err == nil {
+				target, err = jsonPointerAdd(target, path, value)
+			}
+		case "remove":
+			target, _, err = jsonPointerRemove(target, path)
+		case "replace":
+			var value interface{}
+			value, err = decodeJsonValue(op.Value)
+			if err == nil {
+				target, _, err = jsonPointerRemove(target, path)
+			}
+			if err == nil {
+				target, err = jsonPointerAdd(target, path, value)
+			}
+		case "move":
+			from, _ := parseJsonPointer(op.From)
+			var value interface{}
+			target, value, err = jsonPointerRemove(target, from)
+			if err == nil {
+				target, err = jsonPointerAdd(target, path, value)
+			}
+		case "copy":
+			from, _ := parseJsonPointer(op.From)
+			var value interface{}
+			value, err = jsonPointerGet(target, from)
+			if err == nil {
+				target, err = jsonPointerAdd(target, path, deepCopyJsonValue(value))
+			}
+		case "test":
+			var value, actual interface{}
+			value, err = decodeJsonValue(op.Value)
+			if err == nil {
+				actual, err = jsonPointerGet(target, path)
+			}
+			if err == nil && !reflect.DeepEqual(value, actual) {
+				err = fmt.Errorf("test failed for path '%s'", op.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", idx, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+func decodeJsonValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func deepCopyJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = deepCopyJsonValue(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for idx, item := range v {
+			s[idx] = deepCopyJsonValue(item)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer '%s'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for idx := range tokens {
+		tokens[idx] = strings.Replace(strings.Replace(tokens[idx], "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path member '%s' not found", token)
+			}
+			current = value
+		case []interface{}:
+			idx, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			current = node[idx]
+		default:
+			return nil, fmt.Errorf("path member '%s' not found", token)
+		}
+	}
+	return current, nil
+}
+
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := jsonPointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx := len(node)
+		if last != "-" {
+			if idx, err = jsonArrayIndex(last, len(node)); err != nil {
+				return nil, err
+			}
+		}
+		node = append(node, nil)
+		copy(node[idx+1:], node[idx:])
+		node[idx] = value
+		return jsonPointerReplaceParent(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("path member '%s' has no parent container", last)
+	}
+}
+
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := jsonPointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path member '%s' not found", last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		idx, err := jsonArrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[idx]
+		node = append(node[:idx], node[idx+1:]...)
+		doc, err = jsonPointerReplaceParent(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("path member '%s' not found", last)
+	}
+}
+
+// jsonPointerReplaceParent stores an array back into its parent after it was resized.
+func jsonPointerReplaceParent(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := jsonPointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		idx, err := jsonArrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = value
+	}
+	return doc, nil
+}
+
+func jsonArrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	if idx > max {
+		return 0, errors.New("array index out of bounds")
+	}
+	return idx, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"reflect"
+	"testing"
+)
+
+func TestJsonPatch(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	doc := `{"id":"1","name":"TestName","description":"TestDescription","latitude":"41.38","longitude":"2.17"}`
+	assertJson := func(t *testing.T, actual []byte, expected string) {
+		var a, e interface{}
+		if err := json.Unmarshal(actual, &a); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(expected), &e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(a, e) {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+	}
+
+	test.Run("merge-patch", func(t *testing.T) {
+		patched, err := applyMergePatch([]byte(doc), []byte(`{"description":null,"latitude":null,"longitude":null,"name":"NewName"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJson(t, patched, `{"id":"1","name":"NewName"}`)
+	})
+
+	test.Run("json-patch", func(t *testing.T) {
+		ops, err := decodeJsonPatch([]byte(`[
+			{"op":"test","path":"/name","value":"TestName"},
+			{"op":"replace","path":"/latitude","value":null},
+			{"op":"remove","path":"/longitude"},
+			{"op":"copy","from":"/name","path":"/description"}
+		]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := applyJsonPatch([]byte(doc), ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJson(t, patched, `{"id":"1","name":"TestName","description":"TestName","latitude":null}`)
+	})
+
+	test.Run("json-patch-arrays", func(t *testing.T) {
+		ops, err := decodeJsonPatch([]byte(`[
+			{"op":"add","path":"/tags/-","value":"c"},
+			{"op":"add","path":"/tags/0","value":"z"},
+			{"op":"move","from":"/tags/1","path":"/first"}
+		]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := applyJsonPatch([]byte(`{"tags":["a","b"]}`), ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJson(t, patched, `{"tags":["z","b","c"],"first":"a"}`)
+	})
+
+	test.Run("json-patch-test-fails", func(t *testing.T) {
+		ops, err := decodeJsonPatch([]byte(`[{"op":"test","path":"/name","value":"Other"},{"op":"remove","path":"/name"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := applyJsonPatch([]byte(doc), ops); err == nil {
+			t.Fatal("expected the test operation to fail")
+		}
+	})
+
+	test.Run("json-patch-invalid", func(t *testing.T) {
+		for _, patch := range []string{`{"op":"remove"}`, `[{"op":"drop","path":"/name"}]`, `[{"op":"add","path":"/name"}]`, `[{"op":"remove","path":"name"}]`} {
+			if _, err := decodeJsonPatch([]byte(patch)); err == nil {
+				t.Fatalf("expected %s to be rejected", patch)
+			}
+		}
+	})
+}
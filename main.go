@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
@@ -17,6 +19,7 @@ import (
 	"os/signal"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -24,6 +27,16 @@ import (
 var GitCommit string
 var GitSourceRoot string
 
+// corsOrigins are the origins allowed to call the gateway from a browser, every one
+// unless APP_CORS_ORIGINS lists them. An origin may have a "*" wildcard.
+var corsOrigins []string
+
+func init() {
+	if value, ok := os.LookupEnv("APP_CORS_ORIGINS"); ok {
+		corsOrigins = splitQueryList(value)
+	}
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Llongfile)
 	rand.Seed(time.Now().UnixNano())
@@ -38,16 +51,26 @@ func main() {
 	}
 	defer scopeAgent.Stop()
 
+	if err := openDataStores(dataDir); err != nil {
+		log.Fatalf("data stores: %v", err)
+	}
+
 	log.Println("Starting server...")
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	r.Use(cors.New(cors.Config{
-		AllowAllOrigins: true,
+		AllowAllOrigins: len(corsOrigins) == 0,
+		AllowOrigins:    corsOrigins,
 		AllowMethods:    []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
 		AllowHeaders: []string{
 			"Origin",
 			"Content-Length",
 			"Content-Type",
+			"Authorization",
+			"If-Match",
+			"Idempotency-Key",
+			"Last-Event-ID",
+			"X-Device-Id",
 			"ot-tracer-traceid",
 			"ot-tracer-spanid",
 			"ot-tracer-parentspanid",
@@ -56,6 +79,7 @@ func main() {
 			"traceparent",
 			"tracestate",
 		},
+		ExposeHeaders:          []string{"ETag", "Idempotent-Replayed"},
 		AllowCredentials:       true,
 		MaxAge:                 30 * time.Second,
 		AllowWildcard:          true,
@@ -65,13 +89,34 @@ func main() {
 	}))
 	r.Use(logErrorOnSpanMiddleware)
 	r.Use(errorInjectionMiddleware)
-	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	compress := gzip.Gzip(gzip.DefaultCompression)
+	r.Use(func(c *gin.Context) {
+		// the gzip writer holds everything back until the response ends, so streams skip it
+		if path := c.Request.URL.Path; path != eventsPath && path != exportPath {
+			compress(c)
+		}
+	})
 	r.GET("/", func(c *gin.Context) {
 		c.Status(http.StatusOK)
 	})
 	addImageServiceEndpoints(r)
 	addRatingServiceEndpoints(r)
 	addRestaurantServiceEndpoints(r)
+	addFavoriteEndpoints(r)
+	addTagEndpoints(r)
+	addReviewEndpoints(r)
+	addEventEndpoints(r)
+	addWebhookEndpoints(r)
+	events.listen(webhooks.enqueue)
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go imageCleanup.run(workersCtx)
+	go trash.run(workersCtx)
+	go webhooks.run(workersCtx)
+	go topRestaurants.run(workersCtx)
+	go restaurantSimilarities.run(workersCtx)
+
 	srv := &http.Server{
 		Addr:    ":80",
 		Handler: nethttp.Middleware(r, nethttp.MWPayloadInstrumentation()),
@@ -98,6 +143,15 @@ func main() {
 	log.Println("Server exiting")
 }
 
+// newId returns a random identifier for records the gateway owns.
+func newId() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func getUrl(base string, pathValues ...string) (string, error) {
 	url, err := url.Parse(base)
 	if err != nil {
@@ -153,6 +207,21 @@ func logErrorOnSpanMiddleware(c *gin.Context) {
 	c.Next()
 }
 
+// originAllowed tells whether an origin is one of the configured CORS origins.
+func originAllowed(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if idx := strings.Index(allowed, "*"); idx >= 0 {
+			prefix, suffix := allowed[:idx], allowed[idx+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		} else if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 func logError(c *gin.Context, err error) {
 	sp := opentracing.SpanFromContext(c.Request.Context())
 	if sp != nil {
@@ -6,6 +6,7 @@ import (
 	"go.undefinedlabs.com/scopeagent/agent"
 	"go.undefinedlabs.com/scopeagent/instrumentation/nethttp"
 	scopetesting "go.undefinedlabs.com/scopeagent/instrumentation/testing"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -19,9 +20,19 @@ func TestMain(m *testing.M) {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Llongfile)
 	nethttp.PatchHttpDefaultClient(nethttp.WithPayloadInstrumentation())
 	rand.Seed(time.Now().UnixNano())
+	dir, err := ioutil.TempDir("", "go-demo-app")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := openDataStores(dir); err != nil {
+		log.Fatal(err)
+	}
+	userTokenSecret = "test-secret"
 	router = setupRouter()
 	scopetesting.PatchTestingLogger()
-	os.Exit(scopeagent.Run(m, agent.WithSetGlobalTracer(), agent.WithDebugEnabled(), agent.WithRetriesOnFail(3)))
+	code := scopeagent.Run(m, agent.WithSetGlobalTracer(), agent.WithDebugEnabled(), agent.WithRetriesOnFail(3))
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func setupRouter() *gin.Engine {
@@ -31,5 +42,10 @@ func setupRouter() *gin.Engine {
 	addImageServiceEndpoints(r)
 	addRatingServiceEndpoints(r)
 	addRestaurantServiceEndpoints(r)
+	addFavoriteEndpoints(r)
+	addTagEndpoints(r)
+	addReviewEndpoints(r)
+	addEventEndpoints(r)
+	addWebhookEndpoints(r)
 	return r
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ratingVelocityWindow = time.Minute
+	ratingBurstWindow    = 10 * time.Minute
+	ratingBurstShare     = 0.8
+	ratingFlagDuration   = time.Hour
+)
+
+type (
+	// ratingGuard protects the rating service from vote flooding. Clients and
+	// restaurants are limited to a number of votes per minute, and a restaurant that
+	// gets a burst of extreme scores is flagged: its votes are quarantined until an
+	// admin approves or rejects them.
+	ratingGuard struct {
+		sync.Mutex
+		path        string
+		clients     map[string][]time.Time
+		restaurants map[string][]ratingSubmission
+		flags       map[string]time.Time
+		quarantine  []*quarantinedVote
+		lastSweep   time.Time
+	}
+
+	ratingSubmission struct {
+		at      time.Time
+		extreme bool
+	}
+
+	quarantinedVote struct {
+		Id           string    `json:"id"`
+		RestaurantId string    `json:"restaurantId"`
+		Voter        string    `json:"voter"`
+		ClientIP     string    `json:"clientIp"`
+		Score        int       `json:"score"`
+		Comment      string    `json:"comment,omitempty"`
+		Reason       string    `json:"reason"`
+		At           time.Time `json:"at"`
+	}
+
+	ratingFlag struct {
+		RestaurantId string    `json:"restaurantId"`
+		Until        time.Time `json:"until"`
+	}
+)
+
+var (
+	ratingClientLimit     = 10
+	ratingRestaurantLimit = 120
+	ratingBurstThreshold  = 20
+	ratingGuards          *ratingGuard
+)
+
+func init() {
+	for env, value := range map[string]*int{
+		"APP_RATING_CLIENT_LIMIT":     &ratingClientLimit,
+		"APP_RATING_RESTAURANT_LIMIT": &ratingRestaurantLimit,
+		"APP_RATING_BURST_THRESHOLD":  &ratingBurstThreshold,
+	} {
+		if s, ok := os.LookupEnv(env); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				log.Fatalf("%s: invalid value '%s'", env, s)
+			}
+			*value = n
+		}
+	}
+}
+
+func newRatingGuard(path string) (*ratingGuard, error) {
+	guard := &ratingGuard{
+		path:        path,
+		clients:     map[string][]time.Time{},
+		restaurants: map[string][]ratingSubmission{},
+		flags:       map[string]time.Time{},
+	}
+	if err := readJsonFile(path, &guard.quarantine); err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+func addRatingGuardEndpoints(admin *gin.RouterGroup) {
+	admin.GET("/rating-quarantine", getQuarantinedVotes)
+	admin.POST("/rating-quarantine/:voteId/approve", approveQuarantinedVote)
+	admin.POST("/rating-quarantine/:voteId/reject", rejectQuarantinedVote)
+	admin.GET("/rating-flags", getRatingFlags)
+	admin.DELETE("/rating-flags/:restaurantId", deleteRatingFlag)
+}
+
+// screenRating enforces the velocity limits on a vote, aborting with 429 when they are
+// exceeded, and tells whether the vote was quarantined.
+func screenRating(c *gin.Context, restaurantId string, voter string, rq ratingPost) bool {
+	vote := quarantinedVote{RestaurantId: restaurantId, Voter: voter, ClientIP: clientAddress(c), Score: *rq.Score, Comment: rq.Comment}
+	retryAfter, quarantined, err := ratingGuards.screen(vote, time.Now())
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		err := errors.New("too many ratings, try again later")
+		c.AbortWithError(http.StatusTooManyRequests, err)
+		panic(err)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	return quarantined
+}
+
+func getQuarantinedVotes(c *gin.Context) {
+	c.JSON(http.StatusOK, ratingGuards.quarantined())
+}
+
+func approveQuarantinedVote(c *gin.Context) {
+	vote, ok := ratingGuards.release(c.Param("voteId"))
+	if !ok {
+		err := errors.New("quarantined vote not found")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	score := vote.Score
+	unlock := lockRestaurant(vote.RestaurantId)
+	defer unlock()
+	newRating, err := applyRating(c.Request.Context(), vote.RestaurantId, vote.Voter, ratingPost{Score: &score, Comment: vote.Comment})
+	if err != nil {
+		// put it back so the approval can be retried
+		if err := ratingGuards.hold(vote); err != nil {
+			logError(c, err)
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, ratings.aggregate(vote.RestaurantId, newRating))
+}
+
+func rejectQuarantinedVote(c *gin.Context) {
+	if _, ok := ratingGuards.release(c.Param("voteId")); !ok {
+		err := errors.New("quarantined vote not found")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func getRatingFlags(c *gin.Context) {
+	c.JSON(http.StatusOK, ratingGuards.flagged(time.Now()))
+}
+
+func deleteRatingFlag(c *gin.Context) {
+	ratingGuards.unflag(c.Param("restaurantId"))
+	c.Status(http.StatusNoContent)
+}
+
+// screen records a vote against the limits. It returns how long the client has to wait
+// when a limit is exceeded, or whether the vote went to quarantine.
+func (g *ratingGuard) screen(vote quarantinedVote, now time.Time) (time.Duration, bool, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.sweep(now)
+
+	clientKeys := []string{vote.Voter, "ip:" + vote.ClientIP}
+	for _, key := range clientKeys {
+		recent := pruneTimes(g.clients[key], now.Add(-ratingVelocityWindow))
+		g.clients[key] = recent
+		if len(recent) >= ratingClientLimit {
+			return recent[0].Add(ratingVelocityWindow).Sub(now), false, nil
+		}
+	}
+	var submissions []ratingSubmission
+	perMinute := 0
+	extreme := 0
+	for _, s := range g.restaurants[vote.RestaurantId] {
+		if s.at.After(now.Add(-ratingBurstWindow)) {
+			submissions = append(submissions, s)
+			if s.at.After(now.Add(-ratingVelocityWindow)) {
+				perMinute++
+			}
+			if s.extreme {
+				extreme++
+			}
+		}
+	}
+	g.restaurants[vote.RestaurantId] = submissions
+	if perMinute >= ratingRestaurantLimit {
+		return ratingVelocityWindow, false, nil
+	}
+
+	for _, key := range clientKeys {
+		g.clients[key] = append(g.clients[key], now)
+	}
+	submission := ratingSubmission{at: now, extreme: vote.Score == ratingMinScore || vote.Score == ratingMaxScore}
+	g.restaurants[vote.RestaurantId] = append(submissions, submission)
+	if submission.extreme {
+		extreme++
+	}
+	total := len(submissions) + 1
+	if extreme >= ratingBurstThreshold && float64(extreme)/float64(total) >= ratingBurstShare {
+		if g.flags[vote.RestaurantId].Before(now) {
+			log.Printf("rating guard: flagging restaurant %s after %d extreme votes in %v", vote.RestaurantId, extreme, ratingBurstWindow)
+		}
+		g.flags[vote.RestaurantId] = now.Add(ratingFlagDuration)
+	}
+	if !g.flags[vote.RestaurantId].After(now) {
+		return 0, false, nil
+	}
+
+	vote.Id = newId()
+	vote.At = now
+	vote.Reason = fmt.Sprintf("burst of extreme scores, flagged until %s", g.flags[vote.RestaurantId].Format(time.RFC3339))
+	g.quarantine = append(g.quarantine, &vote)
+	return 0, true, writeJsonFile(g.path, g.quarantine)
+}
+
+func (g *ratingGuard) quarantined() []quarantinedVote {
+	g.Lock()
+	defer g.Unlock()
+	votes := make([]quarantinedVote, 0, len(g.quarantine))
+	for _, vote := range g.quarantine {
+		votes = append(votes, *vote)
+	}
+	return votes
+}
+
+// release takes a vote out of quarantine.
+func (g *ratingGuard) release(voteId string) (quarantinedVote, bool) {
+	g.Lock()
+	defer g.Unlock()
+	for idx, vote := range g.quarantine {
+		if vote.Id == voteId {
+			g.quarantine = append(g.quarantine[:idx], g.quarantine[idx+1:]...)
+			if err := writeJsonFile(g.path, g.quarantine); err != nil {
+				log.Printf("rating quarantine: %v", err)
+			}
+			return *vote, true
+		}
+	}
+	return quarantinedVote{}, false
+}
+
+func (g *ratingGuard) hold(vote quarantinedVote) error {
+	g.Lock()
+	defer g.Unlock()
+	g.quarantine = append(g.quarantine, &vote)
+	return writeJsonFile(g.path, g.quarantine)
+}
+
+func (g *ratingGuard) flagged(now time.Time) []ratingFlag {
+	g.Lock()
+	defer g.Unlock()
+	flags := []ratingFlag{}
+	for restaurantId, until := range g.flags {
+		if until.After(now) {
+			flags = append(flags, ratingFlag{RestaurantId: restaurantId, Until: until})
+		} else {
+			delete(g.flags, restaurantId)
+		}
+	}
+	return flags
+}
+
+func (g *ratingGuard) unflag(restaurantId string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.flags, restaurantId)
+	// start counting again, or the next vote would raise the flag right away
+	delete(g.restaurants, restaurantId)
+}
+
+// sweep forgets the clients and restaurants without recent votes, every so often.
+func (g *ratingGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < ratingBurstWindow {
+		return
+	}
+	g.lastSweep = now
+	for key, times := range g.clients {
+		if len(pruneTimes(times, now.Add(-ratingVelocityWindow))) == 0 {
+			delete(g.clients, key)
+		}
+	}
+	for restaurantId, submissions := range g.restaurants {
+		if len(submissions) == 0 || !submissions[len(submissions)-1].at.After(now.Add(-ratingBurstWindow)) {
+			delete(g.restaurants, restaurantId)
+		}
+	}
+}
+
+func pruneTimes(times []time.Time, since time.Time) []time.Time {
+	idx := 0
+	for idx < len(times) && !times[idx].After(since) {
+		idx++
+	}
+	return times[idx:]
+}
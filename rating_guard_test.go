@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRatingGuard(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	dir, err := ioutil.TempDir("", "rating-guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	test.Run("client-limit", func(t *testing.T) {
+		guard, err := newRatingGuard(filepath.Join(dir, "client.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		vote := quarantinedVote{RestaurantId: "1", Voter: "user:bot", ClientIP: "10.0.0.1", Score: 3}
+		for i := 0; i < ratingClientLimit; i++ {
+			if retryAfter, _, _ := guard.screen(vote, now); retryAfter != 0 {
+				t.Fatalf("vote %d limited", i)
+			}
+		}
+		if retryAfter, _, _ := guard.screen(vote, now); retryAfter <= 0 {
+			t.Fatal("client limit not enforced")
+		}
+		// another user behind the same address is limited too
+		vote.Voter = "user:other"
+		if retryAfter, _, _ := guard.screen(vote, now); retryAfter <= 0 {
+			t.Fatal("address limit not enforced")
+		}
+		if retryAfter, _, _ := guard.screen(vote, now.Add(ratingVelocityWindow+time.Second)); retryAfter != 0 {
+			t.Fatal("limit not lifted after the window")
+		}
+	})
+
+	test.Run("burst", func(t *testing.T) {
+		path := filepath.Join(dir, "burst.json")
+		guard, err := newRatingGuard(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		var quarantined bool
+		for i := 0; i < ratingBurstThreshold; i++ {
+			vote := quarantinedVote{RestaurantId: "1", Voter: fmt.Sprintf("user:%d", i), ClientIP: fmt.Sprintf("10.0.1.%d", i), Score: ratingMaxScore}
+			_, quarantined, err = guard.screen(vote, now.Add(time.Duration(i)*5*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !quarantined || len(guard.flagged(now)) != 1 {
+			t.Fatal("burst of extreme votes not flagged")
+		}
+		reloaded, err := newRatingGuard(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		votes := reloaded.quarantined()
+		if len(votes) != 1 || votes[0].Score != ratingMaxScore || votes[0].Reason == "" {
+			t.Fatalf("unexpected quarantine: %+v", votes)
+		}
+		if _, ok := reloaded.release(votes[0].Id); !ok || len(reloaded.quarantined()) != 0 {
+			t.Fatal("vote not released")
+		}
+
+		guard.unflag("1")
+		vote := quarantinedVote{RestaurantId: "1", Voter: "user:late", ClientIP: "10.0.2.1", Score: ratingMaxScore}
+		if _, quarantined, _ := guard.screen(vote, now.Add(2*time.Minute)); quarantined {
+			t.Fatal("vote quarantined after the flag was cleared")
+		}
+	})
+
+	test.Run("admin-disabled", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/admin/rating-quarantine"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
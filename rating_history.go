@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	historyDefaultPeriods = 30
+	historyMaxPeriods     = 366
+)
+
+type (
+	// ratingSeries records every vote applied through the gateway as a time series: the
+	// ratings forwarded to the rating service and the votes replaced or withdrawn in the
+	// ledger. Points are appended to a JSON lines file, which is only rewritten when the points of
+	// a restaurant are dropped.
+	ratingSeries struct {
+		sync.Mutex
+		path   string
+		points map[string][]ratingPoint
+	}
+
+	// ratingPoint is a vote cast, or withdrawn when Withdrawn is set. Previous is the
+	// score a replaced vote had.
+	ratingPoint struct {
+		RestaurantId string    `json:"restaurantId"`
+		Score        int       `json:"score"`
+		Previous     *int      `json:"previous,omitempty"`
+		Withdrawn    bool      `json:"withdrawn,omitempty"`
+		At           time.Time `json:"at"`
+	}
+
+	ratingBucket struct {
+		Start     time.Time `json:"start"`
+		Average   *float64  `json:"average"`
+		Count     int       `json:"count"`
+		Withdrawn int       `json:"withdrawn"`
+	}
+
+	ratingTrend struct {
+		RestaurantId string         `json:"restaurantId"`
+		Bucket       string         `json:"bucket"`
+		Buckets      []ratingBucket `json:"buckets"`
+	}
+)
+
+var ratingHistory *ratingSeries
+
+func newRatingSeries(path string) (*ratingSeries, error) {
+	series := &ratingSeries{path: path, points: map[string][]ratingPoint{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return series, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a crash may leave the last line half written, which the next append would join
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		log.Printf("rating history: dropping %d bytes of a partial last line", len(data)-end)
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return nil, err
+		}
+		data = data[:end]
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var point ratingPoint
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil {
+			log.Printf("rating history: skipping line: %v", err)
+			continue
+		}
+		series.points[point.RestaurantId] = append(series.points[point.RestaurantId], point)
+	}
+	return series, scanner.Err()
+}
+
+// getRatingHistory returns the average score and the number of votes cast, replacements
+// included, and the number of votes withdrawn in the last periods, a day or a week each,
+// oldest first. Periods without votes are included so the buckets can be charted as they
+// are.
+func getRatingHistory(c *gin.Context) {
+	bucket := c.DefaultQuery("bucket", "day")
+	if bucket != "day" && bucket != "week" {
+		err := errors.New("query parameter 'bucket' must be 'day' or 'week'")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	periods := historyDefaultPeriods
+	if q := c.Query("periods"); q != "" {
+		value, err := strconv.Atoi(q)
+		if err != nil || value <= 0 || value > historyMaxPeriods {
+			err = fmt.Errorf("query parameter 'periods' must be between 1 and %d", historyMaxPeriods)
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		periods = value
+	}
+	restaurantId := c.Param("restaurantId")
+	requireRestaurant(c, restaurantId)
+	c.JSON(http.StatusOK, ratingTrend{
+		RestaurantId: restaurantId,
+		Bucket:       bucket,
+		Buckets:      ratingHistory.buckets(restaurantId, bucket, periods, time.Now()),
+	})
+}
+
+// record adds a first vote.
+func (s *ratingSeries) record(restaurantId string, score int, at time.Time) error {
+	return s.append(ratingPoint{RestaurantId: restaurantId, Score: score, At: at.UTC()})
+}
+
+// replace adds a vote that replaced one with the previous score.
+func (s *ratingSeries) replace(restaurantId string, score int, previous int, at time.Time) error {
+	return s.append(ratingPoint{RestaurantId: restaurantId, Score: score, Previous: &previous, At: at.UTC()})
+}
+
+// withdraw adds the withdrawal of a vote with the score.
+func (s *ratingSeries) withdraw(restaurantId string, score int, at time.Time) error {
+	return s.append(ratingPoint{RestaurantId: restaurantId, Score: score, Withdrawn: true, At: at.UTC()})
+}
+
+func (s *ratingSeries) append(point ratingPoint) error {
+	line, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	s.points[point.RestaurantId] = append(s.points[point.RestaurantId], point)
+	return nil
+}
+
+// remove drops the points of a restaurant, rewriting the file without them.
+func (s *ratingSeries) remove(restaurantId string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.points[restaurantId]; !ok {
+		return
+	}
+	delete(s.points, restaurantId)
+	if err := s.rewrite(); err != nil {
+		log.Printf("rating history: %v", err)
+	}
+}
+
+func (s *ratingSeries) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, points := range s.points {
+		for _, point := range points {
+			if err = enc.Encode(point); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// buckets aggregates the points of a restaurant into the periods ending with the one
+// that contains now. Days start at midnight UTC and weeks on Monday.
+func (s *ratingSeries) buckets(restaurantId string, bucket string, periods int, now time.Time) []ratingBucket {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	step := func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) }
+	if bucket == "week" {
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+		step = func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) }
+	}
+	first := step(start, -(periods - 1))
+
+	buckets := make([]ratingBucket, periods)
+	sums := make([]int, periods)
+	for idx := range buckets {
+		buckets[idx].Start = step(first, idx)
+	}
+	s.Lock()
+	for _, point := range s.points[restaurantId] {
+		if point.At.Before(first) || !point.At.Before(step(start, 1)) {
+			continue
+		}
+		idx := 0
+		for idx+1 < periods && !point.At.Before(buckets[idx+1].Start) {
+			idx++
+		}
+		if point.Withdrawn {
+			buckets[idx].Withdrawn++
+			continue
+		}
+		buckets[idx].Count++
+		sums[idx] += point.Score
+	}
+	s.Unlock()
+	for idx := range buckets {
+		if buckets[idx].Count > 0 {
+			average := float64(sums[idx]) / float64(buckets[idx].Count)
+			buckets[idx].Average = &average
+		}
+	}
+	return buckets
+}
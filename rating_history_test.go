@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRatingHistory(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	dir, err := ioutil.TempDir("", "rating-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+	// a Wednesday
+	now := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+
+	test.Run("buckets", func(t *testing.T) {
+		series, err := newRatingSeries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, point := range []struct {
+			score int
+			at    time.Time
+		}{
+			{5, now.Add(-time.Hour)},
+			{2, now.Add(-2 * time.Hour)},
+			{4, now.AddDate(0, 0, -2)},
+			{1, now.AddDate(0, 0, -40)},
+		} {
+			if err := series.record("1", point.score, point.at); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := series.replace("1", 3, 2, now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := series.withdraw("1", 5, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := series.record("2", 3, now); err != nil {
+			t.Fatal(err)
+		}
+
+		reloaded, err := newRatingSeries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		days := reloaded.buckets("1", "day", 7, now)
+		if len(days) != 7 || !days[6].Start.Equal(time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected days: %+v", days)
+		}
+		if days[6].Count != 3 || *days[6].Average != 10.0/3 || days[6].Withdrawn != 1 || days[4].Count != 1 || days[5].Average != nil {
+			t.Fatalf("unexpected days: %+v", days)
+		}
+		weeks := reloaded.buckets("1", "week", 2, now)
+		if !weeks[1].Start.Equal(time.Date(2020, 6, 8, 0, 0, 0, 0, time.UTC)) || weeks[1].Count != 4 || weeks[0].Count != 0 {
+			t.Fatalf("unexpected weeks: %+v", weeks)
+		}
+
+		reloaded.remove("1")
+		reloaded, err = newRatingSeries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if days := reloaded.buckets("1", "day", 7, now); days[6].Count != 0 {
+			t.Fatalf("points not removed: %+v", days)
+		}
+		if days := reloaded.buckets("2", "day", 1, now); days[0].Count != 1 {
+			t.Fatalf("points of another restaurant lost: %+v", days)
+		}
+	})
+
+	test.Run("partial-line", func(t *testing.T) {
+		path := filepath.Join(dir, "partial.jsonl")
+		content := `{"restaurantId":"1","score":4,"at":"2020-06-10T10:00:00Z"}` + "\n" + `{"restaurantId":"1","sco`
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		series, err := newRatingSeries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := series.record("1", 2, now); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := newRatingSeries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if days := reloaded.buckets("1", "day", 1, now); days[0].Count != 2 || *days[0].Average != 3 {
+			t.Fatalf("point appended after a partial line lost: %+v", days)
+		}
+	})
+
+	test.Run("get", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/rating/" + restaurantId + "/history?bucket=week&periods=4"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+		var trend ratingTrend
+		if err := json.NewDecoder(res.Body).Decode(&trend); err != nil {
+			t.Fatal(err)
+		}
+		if trend.Bucket != "week" || len(trend.Buckets) != 4 {
+			t.Fatalf("unexpected history: %+v", trend)
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/rating/1/history?bucket=month"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
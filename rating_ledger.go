@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// ratingLedger keeps track of the ratings submitted through the gateway, which the
+	// rating service only reports as an average, and of the vote each user cast. The
+	// rating service can only add ratings, so the ledger also counts what it was sent
+	// and the changes it missed, which reconcile applies to its average.
+	ratingLedger struct {
+		sync.Mutex
+		path    string
+		tallies map[string]*ratingTally
+	}
+
+	ratingTally struct {
+		Histogram map[int]int           `json:"histogram"`
+		Count     int                   `json:"count"`
+		UpdatedAt time.Time             `json:"updatedAt"`
+		Votes     map[string]ratingVote `json:"votes"`
+		// LegacyVotes is the weight of the ratings the restaurant had before the gateway
+		// tracked it, Forwarded the votes sent to the rating service since. Offset sums
+		// the score changes of replaced and withdrawn votes, Removed counts withdrawals.
+		LegacyVotes int `json:"legacyVotes"`
+		Forwarded   int `json:"forwarded"`
+		Offset      int `json:"offset"`
+		Removed     int `json:"removed"`
+	}
+
+	ratingVote struct {
+		Score int       `json:"score"`
+		At    time.Time `json:"at"`
+	}
+)
+
+var ratings *ratingLedger
+
+func newRatingLedger(path string) (*ratingLedger, error) {
+	ledger := &ratingLedger{path: path, tallies: map[string]*ratingTally{}}
+	if err := readJsonFile(path, &ledger.tallies); err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// voteOf returns the vote a user cast for a restaurant.
+func (l *ratingLedger) voteOf(restaurantId string, voter string) (ratingVote, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if tally, ok := l.tallies[restaurantId]; ok {
+		vote, ok := tally.Votes[voter]
+		return vote, ok
+	}
+	return ratingVote{}, false
+}
+
+// tracks tells whether the ledger has a tally for a restaurant.
+func (l *ratingLedger) tracks(restaurantId string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.tallies[restaurantId]
+	return ok
+}
+
+// track starts a tally for a restaurant whose ratings so far weigh legacyVotes votes.
+// A restaurant already tracked is left alone.
+func (l *ratingLedger) track(restaurantId string, legacyVotes int) error {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.tallies[restaurantId]; ok {
+		return nil
+	}
+	l.tallies[restaurantId] = &ratingTally{Histogram: map[int]int{}, LegacyVotes: legacyVotes, UpdatedAt: time.Now().UTC()}
+	return writeJsonFile(l.path, l.tallies)
+}
+
+// vote records the vote of a user, replacing the one they cast before. A first vote is
+// taken as forwarded to the rating service, a replacement only as a change of score.
+func (l *ratingLedger) vote(restaurantId string, voter string, score int) error {
+	l.Lock()
+	defer l.Unlock()
+	tally, ok := l.tallies[restaurantId]
+	if !ok {
+		tally = &ratingTally{Histogram: map[int]int{}}
+		l.tallies[restaurantId] = tally
+	}
+	if tally.Votes == nil {
+		tally.Votes = map[string]ratingVote{}
+	}
+	if previous, ok := tally.Votes[voter]; ok {
+		tally.Histogram[previous.Score]--
+		tally.Count--
+		tally.Offset += score - previous.Score
+	} else {
+		tally.Forwarded++
+	}
+	now := time.Now().UTC()
+	tally.Votes[voter] = ratingVote{Score: score, At: now}
+	tally.Histogram[score]++
+	tally.Count++
+	tally.UpdatedAt = now
+	return writeJsonFile(l.path, l.tallies)
+}
+
+// withdraw removes the vote of a user, telling whether there was one.
+func (l *ratingLedger) withdraw(restaurantId string, voter string) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	tally, ok := l.tallies[restaurantId]
+	if !ok {
+		return false, nil
+	}
+	previous, ok := tally.Votes[voter]
+	if !ok {
+		return false, nil
+	}
+	delete(tally.Votes, voter)
+	tally.Histogram[previous.Score]--
+	tally.Count--
+	tally.Offset -= previous.Score
+	tally.Removed++
+	tally.UpdatedAt = time.Now().UTC()
+	return true, writeJsonFile(l.path, l.tallies)
+}
+
+// reconcile applies the replaced and withdrawn votes to the average of the rating
+// service and returns the resulting rating along with the votes it stands for. The
+// ratings of a restaurant the ledger doesn't track weigh ratingUpstreamVotes votes.
+func (l *ratingLedger) reconcile(restaurantId string, upstream *float64) (*float64, int) {
+	if upstream == nil {
+		return nil, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	tally, ok := l.tallies[restaurantId]
+	if !ok {
+		return upstream, ratingUpstreamVotes
+	}
+	sent := tally.LegacyVotes + tally.Forwarded
+	votes := sent - tally.Removed
+	if votes <= 0 {
+		return nil, 0
+	}
+	rating := (*upstream*float64(sent) + float64(tally.Offset)) / float64(votes)
+	// the legacy weight is a guess, keep its error within the score range
+	rating = math.Max(float64(ratingMinScore), math.Min(float64(ratingMaxScore), rating))
+	return &rating, votes
+}
+
+func (l *ratingLedger) remove(restaurantId string) {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.tallies[restaurantId]; !ok {
+		return
+	}
+	delete(l.tallies, restaurantId)
+	if err := writeJsonFile(l.path, l.tallies); err != nil {
+		log.Printf("rating ledger: %v", err)
+	}
+}
+
+// aggregate joins the rating served for a restaurant with what the ledger knows about
+// it. Every score of the range shows up in the histogram.
+func (l *ratingLedger) aggregate(restaurantId string, rating *float64) ratingAggregate {
+	l.Lock()
+	defer l.Unlock()
+	aggregate := ratingAggregate{RestaurantId: restaurantId, Rating: rating, Histogram: map[string]int{}}
+	for score := ratingMinScore; score <= ratingMaxScore; score++ {
+		aggregate.Histogram[strconv.Itoa(score)] = 0
+	}
+	if tally, ok := l.tallies[restaurantId]; ok {
+		for score, count := range tally.Histogram {
+			if count > 0 {
+				aggregate.Histogram[strconv.Itoa(score)] = count
+			}
+		}
+		aggregate.Count = tally.Count
+		updatedAt := tally.UpdatedAt
+		aggregate.UpdatedAt = &updatedAt
+	}
+	return aggregate
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRatingLedger(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	dir, err := ioutil.TempDir("", "ratings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ratings.json")
+
+	test.Run("breakdown", func(t *testing.T) {
+		ledger, err := newRatingLedger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx, score := range []int{5, 4, 5} {
+			if err := ledger.vote("1", fmt.Sprintf("user:%d", idx), score); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reloaded, err := newRatingLedger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		average := 4.6
+		aggregate := reloaded.aggregate("1", &average)
+		if aggregate.Count != 3 || aggregate.Histogram["5"] != 2 || aggregate.Histogram["4"] != 1 || aggregate.UpdatedAt == nil {
+			t.Fatalf("unexpected aggregate: %+v", aggregate)
+		}
+		if count, ok := aggregate.Histogram["1"]; !ok || count != 0 {
+			t.Fatalf("empty scores missing from the histogram: %v", aggregate.Histogram)
+		}
+
+		if err := reloaded.vote("1", "user:1", 2); err != nil {
+			t.Fatal(err)
+		}
+		if aggregate := reloaded.aggregate("1", nil); aggregate.Count != 3 || aggregate.Histogram["4"] != 0 || aggregate.Histogram["2"] != 1 {
+			t.Fatalf("vote not replaced: %+v", aggregate)
+		}
+		if vote, ok := reloaded.voteOf("1", "user:1"); !ok || vote.Score != 2 {
+			t.Fatalf("unexpected vote: %+v", vote)
+		}
+		if withdrawn, err := reloaded.withdraw("1", "user:1"); err != nil || !withdrawn {
+			t.Fatalf("vote not withdrawn: %v", err)
+		}
+		if withdrawn, _ := reloaded.withdraw("1", "user:1"); withdrawn {
+			t.Fatal("vote withdrawn twice")
+		}
+		if aggregate := reloaded.aggregate("1", nil); aggregate.Count != 2 || aggregate.Histogram["2"] != 0 {
+			t.Fatalf("withdrawn vote still counted: %+v", aggregate)
+		}
+
+		reloaded.remove("1")
+		if aggregate := reloaded.aggregate("1", nil); aggregate.Count != 0 || aggregate.UpdatedAt != nil {
+			t.Fatalf("removed restaurant still tallied: %+v", aggregate)
+		}
+	})
+
+	test.Run("reconcile", func(t *testing.T) {
+		ledger, err := newRatingLedger(filepath.Join(dir, "reconcile.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream := func(rating float64) *float64 { return &rating }
+		if rating, votes := ledger.reconcile("1", upstream(4)); rating == nil || *rating != 4 || votes != ratingUpstreamVotes {
+			t.Fatalf("untracked restaurant: %v, %d votes", rating, votes)
+		}
+		if rating, votes := ledger.reconcile("1", nil); rating != nil || votes != 0 {
+			t.Fatalf("unrated restaurant: %v, %d votes", rating, votes)
+		}
+
+		// two legacy ratings averaging 3, then two votes the rating service got: 5 and 2
+		ledger.track("1", 2)
+		ledger.vote("1", "user:a", 5)
+		ledger.vote("1", "user:b", 2)
+		if rating, votes := ledger.reconcile("1", upstream(3.25)); rating == nil || *rating != 3.25 || votes != 4 {
+			t.Fatalf("unexpected rating: %v, %d votes", rating, votes)
+		}
+		// the rating service keeps the 2, the ledger moves it to 4
+		ledger.vote("1", "user:b", 4)
+		if rating, votes := ledger.reconcile("1", upstream(3.25)); rating == nil || *rating != 3.75 || votes != 4 {
+			t.Fatalf("changed vote not applied: %v, %d votes", rating, votes)
+		}
+		ledger.withdraw("1", "user:a")
+		if rating, votes := ledger.reconcile("1", upstream(3.25)); rating == nil || *rating != 10.0/3 || votes != 3 {
+			t.Fatalf("withdrawn vote still counted: %v, %d votes", rating, votes)
+		}
+
+		ledger.track("2", 0)
+		ledger.vote("2", "user:a", 5)
+		ledger.withdraw("2", "user:a")
+		if rating, votes := ledger.reconcile("2", upstream(5)); rating != nil || votes != 0 {
+			t.Fatalf("every vote withdrawn: %v, %d votes", rating, votes)
+		}
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -14,45 +15,260 @@ import (
 	"time"
 )
 
+const ratingMaxCommentLength = 2000
+
+type (
+	// ratingPost is a rating submission, sent either as JSON or as a bare score in a
+	// text body.
+	ratingPost struct {
+		Score   *int   `json:"score"`
+		Comment string `json:"comment,omitempty"`
+	}
+
+	ratingAggregate struct {
+		RestaurantId string         `json:"restaurantId"`
+		Rating       *float64       `json:"rating"`
+		Count        int            `json:"count"`
+		Histogram    map[string]int `json:"histogram"`
+		UpdatedAt    *time.Time     `json:"updatedAt"`
+		Quarantined  bool           `json:"quarantined,omitempty"`
+	}
+)
+
 var (
-	ratingApiUrl = "https://python-demo-app.undefinedlabs.dev/"
+	ratingApiUrl   = "https://python-demo-app.undefinedlabs.dev/"
+	ratingMinScore = 1
+	ratingMaxScore = 5
+	// ratingUpstreamVotes is how many votes the rating of a restaurant stands for when
+	// the gateway didn't see them, as the rating service doesn't report its counts.
+	ratingUpstreamVotes = 5
 )
 
 func init() {
 	if svc, ok := os.LookupEnv("APP_RATING_SVC"); ok {
 		ratingApiUrl = svc
 	}
+	if value, ok := os.LookupEnv("APP_RATING_MIN_SCORE"); ok {
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("APP_RATING_MIN_SCORE: %v", err)
+		}
+		ratingMinScore = score
+	}
+	if value, ok := os.LookupEnv("APP_RATING_MAX_SCORE"); ok {
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("APP_RATING_MAX_SCORE: %v", err)
+		}
+		ratingMaxScore = score
+	}
+	if value, ok := os.LookupEnv("APP_RATING_UPSTREAM_VOTES"); ok {
+		votes, err := strconv.Atoi(value)
+		if err != nil || votes < 0 {
+			log.Fatalf("APP_RATING_UPSTREAM_VOTES: invalid vote count '%s'", value)
+		}
+		ratingUpstreamVotes = votes
+	}
+	if ratingMinScore > ratingMaxScore {
+		log.Fatalf("rating score range %d..%d is empty", ratingMinScore, ratingMaxScore)
+	}
 }
 
 func addRatingServiceEndpoints(r *gin.Engine) {
-	r.POST("/rating/:restaurantId", postRating)
+	r.GET("/rating/:restaurantId", getRating)
+	r.GET("/rating/:restaurantId/history", getRatingHistory)
+	r.POST("/rating/:restaurantId", idempotencyMiddleware, postRating)
+	r.DELETE("/rating/:restaurantId", deleteRating)
+	addRatingGuardEndpoints(adminRoutes(r))
 }
 
-func postRating(c *gin.Context) {
+// getRating returns the rating of a restaurant, the rating service's average reconciled
+// with the votes changed through the gateway, along with the breakdown of those votes.
+func getRating(c *gin.Context) {
 	ctx := c.Request.Context()
 	restaurantId := c.Param("restaurantId")
-	bytes, err := ioutil.ReadAll(c.Request.Body)
+	rating, err := restaurantRating(ctx, restaurantId)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
-	ratingStr := string(bytes)
-	rating, err := strconv.Atoi(ratingStr)
+	c.JSON(http.StatusOK, ratings.aggregate(restaurantId, rating))
+}
+
+func postRating(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	voter := ratingVoter(c)
+	rq, err := parseRatingPost(c)
 	if err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
 		panic(err)
 	}
-	err = AddRatingToRestaurant(ctx, restaurantId, rating)
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	newRating, quarantined := submitRating(c, restaurantId, voter, rq)
+	aggregate := ratings.aggregate(restaurantId, newRating)
+	if quarantined {
+		aggregate.Quarantined = true
+		c.JSON(http.StatusAccepted, aggregate)
+		return
+	}
+	c.JSON(http.StatusOK, aggregate)
+}
+
+// submitRating screens the vote of a user and applies it, returning the average rating
+// and whether the vote was held back for review instead. The caller holds the lock of
+// the restaurant.
+func submitRating(c *gin.Context, restaurantId string, voter string, rq ratingPost) (*float64, bool) {
+	ctx := c.Request.Context()
+	if screenRating(c, restaurantId, voter, rq) {
+		rating, err := restaurantRating(ctx, restaurantId)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			panic(err)
+		}
+		return rating, true
+	}
+	newRating, err := applyRating(ctx, restaurantId, voter, rq)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	return newRating, false
+}
+
+// applyRating records the vote of a user and returns the new average rating. The caller
+// holds the lock of the restaurant.
+func applyRating(ctx context.Context, restaurantId string, voter string, rq ratingPost) (*float64, error) {
+	// the rating service can only add ratings, so it gets a user's first vote and the
+	// ledger keeps track of the changes, which restaurantRating applies to its average
+	previous, replaced := ratings.voteOf(restaurantId, voter)
+	if !ratings.tracks(restaurantId) {
+		upstream, err := GetRatingByRestaurantId(ctx, restaurantId)
+		if err != nil {
+			return nil, err
+		}
+		legacyVotes := 0
+		if upstream != nil {
+			legacyVotes = ratingUpstreamVotes
+		}
+		if err := ratings.track(restaurantId, legacyVotes); err != nil {
+			return nil, err
+		}
+	}
+	if !replaced {
+		if err := AddRatingToRestaurant(ctx, restaurantId, *rq.Score); err != nil {
+			return nil, err
+		}
+		if err := ratingHistory.record(restaurantId, *rq.Score, time.Now()); err != nil {
+			log.Printf("rating history: %v", err)
+		}
+	}
+	if err := ratings.vote(restaurantId, voter, *rq.Score); err != nil {
+		return nil, err
+	}
+	if replaced {
+		if err := ratingHistory.replace(restaurantId, *rq.Score, previous.Score, time.Now()); err != nil {
+			log.Printf("rating history: %v", err)
+		}
+	}
+	newRating, err := restaurantRating(ctx, restaurantId)
+	if err != nil {
+		return nil, err
+	}
+	if replaced {
+		events.publish(eventRatingUpdated, restaurantId, gin.H{"score": *rq.Score, "previousScore": previous.Score, "comment": rq.Comment, "rating": newRating})
+	} else {
+		events.publish(eventRatingAdded, restaurantId, gin.H{"score": *rq.Score, "comment": rq.Comment, "rating": newRating})
+	}
+	return newRating, nil
+}
+
+func deleteRating(c *gin.Context) {
+	ctx := c.Request.Context()
+	restaurantId := c.Param("restaurantId")
+	voter := ratingVoter(c)
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+
+	previous, _ := ratings.voteOf(restaurantId, voter)
+	withdrawn, err := ratings.withdraw(restaurantId, voter)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
-	newRating, err := GetRatingByRestaurantId(ctx, restaurantId)
+	if !withdrawn {
+		err := errors.New("no rating to withdraw")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if err := ratingHistory.withdraw(restaurantId, previous.Score, time.Now()); err != nil {
+		log.Printf("rating history: %v", err)
+	}
+	rating, err := restaurantRating(ctx, restaurantId)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
-	c.Writer.WriteString(fmt.Sprintf("%v", *newRating))
+	events.publish(eventRatingDeleted, restaurantId, gin.H{"rating": rating})
+	c.JSON(http.StatusOK, ratings.aggregate(restaurantId, rating))
+}
+
+// ratingVoter identifies who is rating, by user when the client sends a user token and
+// by device otherwise. An invalid token is refused rather than taken for a device.
+func ratingVoter(c *gin.Context) string {
+	if c.GetHeader("Authorization") != "" {
+		return "user:" + signedInUser(c)
+	}
+	if deviceId := strings.TrimSpace(c.GetHeader("X-Device-Id")); deviceId != "" {
+		return "device:" + deviceId
+	}
+	err := errors.New("missing user token or X-Device-Id header")
+	c.AbortWithError(http.StatusBadRequest, err)
+	panic(err)
+}
+
+func parseRatingPost(c *gin.Context) (ratingPost, error) {
+	var rq ratingPost
+	if c.ContentType() == gin.MIMEJSON {
+		if err := json.NewDecoder(c.Request.Body).Decode(&rq); err != nil {
+			return rq, err
+		}
+		if rq.Score == nil {
+			return rq, errors.New("missing rating score")
+		}
+	} else {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return rq, err
+		}
+		score, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			return rq, fmt.Errorf("invalid rating score '%s'", strings.TrimSpace(string(body)))
+		}
+		rq.Score = &score
+	}
+	return rq, rq.validate()
+}
+
+func (rq ratingPost) validate() error {
+	if *rq.Score < ratingMinScore || *rq.Score > ratingMaxScore {
+		return fmt.Errorf("rating score must be between %d and %d", ratingMinScore, ratingMaxScore)
+	}
+	if len([]rune(rq.Comment)) > ratingMaxCommentLength {
+		return fmt.Errorf("rating comment is longer than %d characters", ratingMaxCommentLength)
+	}
+	return nil
+}
+
+// restaurantRating returns the rating served for a restaurant: the average of the
+// rating service, with the votes replaced or withdrawn through the gateway applied.
+func restaurantRating(ctx context.Context, restaurantId string) (*float64, error) {
+	upstream, err := GetRatingByRestaurantId(ctx, restaurantId)
+	if err != nil {
+		return nil, err
+	}
+	rating, _ := ratings.reconcile(restaurantId, upstream)
+	return rating, nil
 }
 
 func GetRatingByRestaurantId(ctx context.Context, restaurantId string) (*float64, error) {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/gin-gonic/gin"
 	"go.undefinedlabs.com/scopeagent"
 	"io/ioutil"
 	"net/http"
@@ -31,12 +33,36 @@ func TestRatingService(t *testing.T) {
 		t.Log("all ok")
 	})
 
+	test.Run("get", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		t.Log("get rating")
+
+		url := fmt.Sprintf("/rating/%s", restaurantId)
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+		var aggregate ratingAggregate
+		if err := json.NewDecoder(res.Body).Decode(&aggregate); err != nil {
+			t.Fatal(err)
+		}
+		if aggregate.RestaurantId != restaurantId || len(aggregate.Histogram) == 0 {
+			t.Fatalf("unexpected rating: %+v", aggregate)
+		}
+		t.Log("all ok")
+	})
+
 	test.Run("add", func(t *testing.T) {
 		ctx := scopeagent.GetContextFromTest(t)
 		t.Log("add rating")
 
 		url := fmt.Sprintf("/rating/%s", restaurantId)
 		req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader("4"))
+		req.Header.Set("Authorization", "Bearer "+userToken("rating-service-test"))
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 		res := w.Result()
@@ -54,4 +80,90 @@ func TestRatingService(t *testing.T) {
 		}
 		t.Log("all ok")
 	})
+	test.Run("parse", func(t *testing.T) {
+		for _, c := range []struct {
+			contentType string
+			body        string
+			score       int
+		}{
+			{"text/plain", "4\n", 4},
+			{"", " 5 ", 5},
+			{"application/json", `{"score":3,"comment":"Nice terrace"}`, 3},
+		} {
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request, _ = http.NewRequest("POST", "/rating/1", strings.NewReader(c.body))
+			ctx.Request.Header.Set("Content-Type", c.contentType)
+			rq, err := parseRatingPost(ctx)
+			if err != nil {
+				t.Fatalf("%q: %v", c.body, err)
+			}
+			if *rq.Score != c.score {
+				t.Fatalf("%q: unexpected score %d", c.body, *rq.Score)
+			}
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		for _, c := range []struct {
+			contentType string
+			body        string
+		}{
+			{"text/plain", "-900"},
+			{"text/plain", "four"},
+			{"application/json", `{"comment":"no score"}`},
+			{"application/json", `{"score":4.5}`},
+			{"application/json", `{"score":6}`},
+		} {
+			url := fmt.Sprintf("/rating/%s", restaurantId)
+			req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			req.Header.Set("Authorization", "Bearer "+userToken("rating-service-test"))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%q: expected 400, got %d", c.body, w.Code)
+			}
+		}
+	})
+	test.Run("anonymous", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		for _, method := range []string{"POST", "DELETE"} {
+			url := fmt.Sprintf("/rating/%s", restaurantId)
+			req, _ := http.NewRequestWithContext(ctx, method, url, strings.NewReader("4"))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%s without a voter: expected 400, got %d", method, w.Code)
+			}
+		}
+		req, _ := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("/rating/%s", restaurantId), nil)
+		req.Header.Set("Authorization", "Bearer forged")
+		req.Header.Set("X-Device-Id", "rating-service-test")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("invalid token: expected 401, got %d", w.Code)
+		}
+	})
+
+	test.Run("withdraw-missing", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := fmt.Sprintf("/rating/%s", restaurantId)
+		req, _ := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken("never-voted"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", w.Code)
+		}
+
+		req, _ = http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		req.Header.Set("X-Device-Id", "never-voted")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("device: expected 404, got %d", w.Code)
+		}
+	})
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	duplicateNameThreshold       = 0.9
+	duplicateNearbyNameThreshold = 0.6
+	duplicateNearbyMeters        = 150.0
+	duplicateSameAreaMeters      = 1000.0
+)
+
+// duplicateNameStopWords are left out when comparing names, so "The Joe's Pizza
+// Restaurant" and "Joe's Pizza" compare as the same name.
+var duplicateNameStopWords = map[string]bool{
+	"the": true, "and": true, "restaurant": true, "restaurante": true, "cafe": true, "bar": true,
+}
+
+type duplicateCandidate struct {
+	Restaurant     restaurantApi `json:"restaurant"`
+	NameSimilarity float64       `json:"nameSimilarity"`
+	DistanceMeters *float64      `json:"distanceMeters,omitempty"`
+}
+
+// findDuplicateRestaurants compares a new restaurant with the existing ones and
+// returns the likely duplicates, best match first.
+func findDuplicateRestaurants(ctx context.Context, candidate restaurantApi) ([]duplicateCandidate, error) {
+	existing, err := GetAllRestaurants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return matchDuplicateRestaurants(candidate, trash.filter(existing)), nil
+}
+
+func matchDuplicateRestaurants(candidate restaurantApi, existing []restaurantApi) []duplicateCandidate {
+	name := normalizeRestaurantName(candidate.Name)
+	lat, lng, located := restaurantCoordinates(candidate)
+
+	var matches []duplicateCandidate
+	for _, r := range existing {
+		similarity := nameSimilarity(name, normalizeRestaurantName(r.Name))
+		match := duplicateCandidate{Restaurant: r, NameSimilarity: similarity}
+		otherLat, otherLng, otherLocated := restaurantCoordinates(r)
+		if located && otherLocated {
+			distance := haversineMeters(lat, lng, otherLat, otherLng)
+			match.DistanceMeters = &distance
+			// far apart branches of a chain are not duplicates
+			if (distance <= duplicateNearbyMeters && similarity >= duplicateNearbyNameThreshold) ||
+				(distance <= duplicateSameAreaMeters && similarity >= duplicateNameThreshold) {
+				matches = append(matches, match)
+			}
+		} else if similarity >= duplicateNameThreshold {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].NameSimilarity > matches[j].NameSimilarity
+	})
+	return matches
+}
+
+func normalizeRestaurantName(name string) string {
+	var words []string
+	for _, token := range tokenize(name) {
+		if !duplicateNameStopWords[token] {
+			words = append(words, token)
+		}
+	}
+	if len(words) == 0 {
+		return strings.Join(tokenize(name), " ")
+	}
+	return strings.Join(words, " ")
+}
+
+// nameSimilarity scores two normalized names between 0 and 1, as the best of their
+// edit distance similarity and the overlap of their words.
+func nameSimilarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	longest := math.Max(float64(len([]rune(a))), float64(len([]rune(b))))
+	editSimilarity := 1 - float64(levenshtein(a, b))/longest
+
+	wordsA, wordsB := map[string]bool{}, map[string]bool{}
+	for _, word := range strings.Fields(a) {
+		wordsA[word] = true
+	}
+	for _, word := range strings.Fields(b) {
+		wordsB[word] = true
+	}
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+	jaccard := float64(shared) / float64(len(wordsA)+len(wordsB)-shared)
+	return math.Max(editSimilarity, jaccard)
+}
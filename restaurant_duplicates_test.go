@@ -0,0 +1,54 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"testing"
+)
+
+func TestRestaurantDuplicates(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	located := func(id, name, lat, lng string) restaurantApi {
+		return restaurantApi{Id: id, restaurantApiPost: restaurantApiPost{Name: name}, Latitude: &lat, Longitude: &lng}
+	}
+	existing := []restaurantApi{
+		located("1", "Joe's Pizza", "40.7306", "-73.9866"),
+		located("2", "Joe's Pizza", "34.0522", "-118.2437"),
+		located("3", "Sushi Bar", "40.7310", "-73.9870"),
+		{Id: "4", restaurantApiPost: restaurantApiPost{Name: "The Pasta Palace"}},
+	}
+
+	test.Run("nearby", func(t *testing.T) {
+		matches := matchDuplicateRestaurants(located("", "Joes Pizza Restaurant", "40.7307", "-73.9867"), existing)
+		if len(matches) != 1 || matches[0].Restaurant.Id != "1" || matches[0].DistanceMeters == nil {
+			t.Fatalf("unexpected matches: %+v", matches)
+		}
+	})
+
+	test.Run("typo-nearby", func(t *testing.T) {
+		matches := matchDuplicateRestaurants(located("", "Jo's Piza", "40.7306", "-73.9866"), existing)
+		if len(matches) != 1 || matches[0].Restaurant.Id != "1" {
+			t.Fatalf("unexpected matches: %+v", matches)
+		}
+	})
+
+	test.Run("name-only", func(t *testing.T) {
+		matches := matchDuplicateRestaurants(restaurantApi{restaurantApiPost: restaurantApiPost{Name: "pasta palace"}}, existing)
+		if len(matches) != 1 || matches[0].Restaurant.Id != "4" {
+			t.Fatalf("unexpected matches: %+v", matches)
+		}
+	})
+
+	test.Run("different", func(t *testing.T) {
+		if matches := matchDuplicateRestaurants(located("", "Ramen House", "40.7306", "-73.9866"), existing); len(matches) != 0 {
+			t.Fatalf("unexpected matches: %+v", matches)
+		}
+	})
+
+	test.Run("haversine", func(t *testing.T) {
+		// Barcelona to Madrid is about 505 km
+		if d := haversineMeters(41.3874, 2.1686, 40.4168, -3.7038); d < 500000 || d > 510000 {
+			t.Fatalf("unexpected distance: %v", d)
+		}
+	})
+}
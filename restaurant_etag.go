@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// restaurantLockTable hands out a mutex per restaurant, counting who holds or waits
+	// for it so the entry can be dropped once nobody does.
+	restaurantLockTable struct {
+		sync.Mutex
+		locks map[string]*restaurantLock
+	}
+
+	restaurantLock struct {
+		sync.Mutex
+		holders int
+	}
+)
+
+var (
+	requireIfMatch  = false
+	restaurantLocks = &restaurantLockTable{locks: map[string]*restaurantLock{}}
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_REQUIRE_IF_MATCH"); ok {
+		requireIfMatch, _ = strconv.ParseBool(value)
+	}
+}
+
+// restaurantETag derives a strong version tag from the restaurant as the restaurant
+// service returns it, which has no version of its own.
+func restaurantETag(r restaurantApi) string {
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// lockRestaurant serializes the check-then-write sequences the gateway runs for a
+// restaurant, so two conditional requests can't both pass the same If-Match.
+func lockRestaurant(restaurantId string) func() {
+	t := restaurantLocks
+	t.Lock()
+	lock, ok := t.locks[restaurantId]
+	if !ok {
+		lock = &restaurantLock{}
+		t.locks[restaurantId] = lock
+	}
+	lock.holders++
+	t.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		t.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(t.locks, restaurantId)
+		}
+		t.Unlock()
+	}
+}
+
+// checkRestaurantPreconditions enforces If-Match for a restaurant write. It returns
+// the current restaurant when it had to be fetched for the comparison.
+func checkRestaurantPreconditions(c *gin.Context, restaurantId string) *restaurantApi {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		if requireIfMatch {
+			err := errors.New("an If-Match header is required")
+			c.AbortWithError(http.StatusPreconditionRequired, err)
+			panic(err)
+		}
+		return nil
+	}
+	current, err := GetRestaurantById(c.Request.Context(), restaurantId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if !etagMatches(ifMatch, restaurantETag(*current)) {
+		err := errors.New("restaurant was modified")
+		c.Header("ETag", restaurantETag(*current))
+		c.AbortWithError(http.StatusPreconditionFailed, err)
+		panic(err)
+	}
+	return current
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestaurantETag(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("version", func(t *testing.T) {
+		etag := restaurantETag(benchdata)
+		if etag != restaurantETag(benchdata) {
+			t.Fatal("etag must be stable")
+		}
+		changed := benchdata
+		changed.Description = "Changed"
+		if etag == restaurantETag(changed) {
+			t.Fatal("etag must change with the restaurant")
+		}
+	})
+
+	test.Run("if-match", func(t *testing.T) {
+		etag := restaurantETag(benchdata)
+		if !etagMatches(etag, etag) || !etagMatches(`"other", `+etag, etag) || !etagMatches("*", etag) {
+			t.Fatal("expected the etag to match")
+		}
+		if etagMatches(`"other"`, etag) || etagMatches("W/"+etag, etag) {
+			t.Fatal("expected the etag not to match")
+		}
+	})
+
+	test.Run("precondition-required", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		requireIfMatch = true
+		defer func() { requireIfMatch = false }()
+
+		for _, method := range []string{"PATCH", "DELETE"} {
+			url := "/restaurants/" + benchdata.Id
+			req, _ := http.NewRequestWithContext(ctx, method, url, strings.NewReader(`{"name":"TestName"}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			res := w.Result()
+
+			if res.StatusCode != http.StatusPreconditionRequired {
+				t.Fatalf("server: %s %s respond: %d: %s", method, url, res.StatusCode, res.Status)
+			}
+		}
+	})
+
+	test.Run("locks", func(t *testing.T) {
+		unlock := lockRestaurant("lock-test")
+		done := make(chan bool)
+		go func() {
+			lockRestaurant("lock-test")()
+			done <- true
+		}()
+		select {
+		case <-done:
+			t.Fatal("lock acquired twice")
+		case <-time.After(20 * time.Millisecond):
+		}
+		unlock()
+		<-done
+
+		restaurantLocks.Lock()
+		defer restaurantLocks.Unlock()
+		if len(restaurantLocks.locks) != 0 {
+			t.Fatalf("locks left behind: %d", len(restaurantLocks.locks))
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	exportPath        = "/restaurants:export"
+	exportConcurrency = 8
+)
+
+type (
+	// restaurantExporter writes restaurants one at a time in an export format.
+	restaurantExporter interface {
+		write(rest restaurant) error
+		close() error
+	}
+
+	csvRestaurantExporter struct {
+		w *csv.Writer
+	}
+
+	ndjsonRestaurantExporter struct {
+		encoder *json.Encoder
+	}
+
+	geojsonRestaurantExporter struct {
+		w     io.Writer
+		count int
+	}
+
+	geojsonFeature struct {
+		Type       string                 `json:"type"`
+		Geometry   *geojsonPoint          `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	geojsonPoint struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+
+	// exportedRestaurant is a looked up restaurant along with the lookups that failed,
+	// which the workers leave to the handler to log.
+	exportedRestaurant struct {
+		restaurant
+		errs []error
+	}
+)
+
+var restaurantExportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":     {"text/csv", "csv"},
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"geojson": {"application/geo+json", "geojson"},
+}
+
+// exportRestaurants streams every restaurant joined with its rating and images, writing
+// each one as soon as its lookups are done.
+func exportRestaurants(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	exportFormat, ok := restaurantExportFormats[format]
+	if !ok {
+		err := fmt.Errorf("unknown export format '%s'", format)
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	r, err := GetAllRestaurants(ctx)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	r = trash.filter(r)
+
+	c.Header("Content-Type", exportFormat.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="restaurants.%s"`, exportFormat.extension))
+	c.Status(http.StatusOK)
+	exporter, err := newRestaurantExporter(format, c.Writer)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	for rest := range aggregateRestaurants(ctx, r) {
+		for _, err := range rest.errs {
+			logError(c, err)
+		}
+		if err := exporter.write(rest.restaurant); err != nil {
+			// the client is gone, stop the remaining lookups
+			logError(c, err)
+			return
+		}
+		c.Writer.Flush()
+	}
+	if err := exporter.close(); err != nil {
+		logError(c, err)
+	}
+}
+
+// aggregateRestaurants looks up the images and rating of every restaurant with bounded
+// concurrency and sends the results as they complete.
+func aggregateRestaurants(ctx context.Context, r []restaurantApi) <-chan exportedRestaurant {
+	out := make(chan exportedRestaurant)
+	in := make(chan restaurantApi)
+	var wg sync.WaitGroup
+	wg.Add(exportConcurrency)
+	for i := 0; i < exportConcurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				rest := exportedRestaurant{restaurant: newRestaurant(item)}
+				imgs, err := GetImagesByRestaurant(ctx, item.Id)
+				if err != nil {
+					rest.errs = append(rest.errs, err)
+				}
+				for _, img := range imgs {
+					rest.Images = append(rest.Images, fmt.Sprintf("/images/%s", img))
+				}
+				if rest.Rating, err = restaurantRating(ctx, item.Id); err != nil {
+					rest.errs = append(rest.errs, err)
+				}
+				select {
+				case out <- rest:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(in)
+		for _, item := range r {
+			select {
+			case in <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func newRestaurantExporter(format string, w io.Writer) (restaurantExporter, error) {
+	switch format {
+	case "csv":
+		exporter := &csvRestaurantExporter{w: csv.NewWriter(w)}
+		return exporter, exporter.writeRecord([]string{"id", "name", "description", "latitude", "longitude", "rating", "images"})
+	case "ndjson":
+		return &ndjsonRestaurantExporter{encoder: json.NewEncoder(w)}, nil
+	case "geojson":
+		_, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`)
+		return &geojsonRestaurantExporter{w: w}, err
+	default:
+		return nil, fmt.Errorf("unknown export format '%s'", format)
+	}
+}
+
+func (e *csvRestaurantExporter) write(rest restaurant) error {
+	rating := ""
+	if rest.Rating != nil {
+		rating = strconv.FormatFloat(*rest.Rating, 'f', -1, 64)
+	}
+	return e.writeRecord([]string{
+		rest.Id,
+		rest.Name,
+		rest.Description,
+		stringOrEmpty(rest.Latitude),
+		stringOrEmpty(rest.Longitude),
+		rating,
+		strings.Join(rest.Images, ";"),
+	})
+}
+
+func (e *csvRestaurantExporter) writeRecord(record []string) error {
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvRestaurantExporter) close() error {
+	return nil
+}
+
+func (e *ndjsonRestaurantExporter) write(rest restaurant) error {
+	return e.encoder.Encode(rest)
+}
+
+func (e *ndjsonRestaurantExporter) close() error {
+	return nil
+}
+
+func (e *geojsonRestaurantExporter) write(rest restaurant) error {
+	feature := geojsonFeature{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"id":          rest.Id,
+			"name":        rest.Name,
+			"description": rest.Description,
+			"rating":      rest.Rating,
+			"images":      rest.Images,
+		},
+	}
+	if lat, lng, ok := restaurantCoordinates(rest.restaurantApi); ok {
+		// GeoJSON positions are longitude first
+		feature.Geometry = &geojsonPoint{Type: "Point", Coordinates: [2]float64{lng, lat}}
+	}
+	data, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *geojsonRestaurantExporter) close() error {
+	_, err := io.WriteString(e.w, "]}")
+	return err
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
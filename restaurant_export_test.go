@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"testing"
+)
+
+func TestRestaurantExport(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	lat, lng, rating := "41.38", "2.17", 4.5
+	rests := []restaurant{
+		{restaurantApi: restaurantApi{Id: "1", restaurantApiPost: restaurantApiPost{Name: "Joe's Pizza"}, Latitude: &lat, Longitude: &lng}, Rating: &rating, Images: []string{"/images/a", "/images/b"}},
+		{restaurantApi: restaurantApi{Id: "2", restaurantApiPost: restaurantApiPost{Name: "Sushi Bar", Description: "Nigiri, maki"}}},
+	}
+	export := func(t *testing.T, format string) []byte {
+		var buf bytes.Buffer
+		exporter, err := newRestaurantExporter(format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rest := range rests {
+			if err := exporter.write(rest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := exporter.close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	test.Run("csv", func(t *testing.T) {
+		records, err := csv.NewReader(bytes.NewReader(export(t, "csv"))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 || records[1][5] != "4.5" || records[1][6] != "/images/a;/images/b" || records[2][2] != "Nigiri, maki" {
+			t.Fatalf("unexpected records: %v", records)
+		}
+	})
+
+	test.Run("ndjson", func(t *testing.T) {
+		lines := bytes.Split(bytes.TrimSpace(export(t, "ndjson")), []byte("\n"))
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 lines, got %d", len(lines))
+		}
+		var rest restaurant
+		if err := json.Unmarshal(lines[0], &rest); err != nil || rest.Id != "1" {
+			t.Fatalf("unexpected line %s: %v", lines[0], err)
+		}
+	})
+
+	test.Run("geojson", func(t *testing.T) {
+		var collection struct {
+			Type     string           `json:"type"`
+			Features []geojsonFeature `json:"features"`
+		}
+		if err := json.Unmarshal(export(t, "geojson"), &collection); err != nil {
+			t.Fatal(err)
+		}
+		if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+			t.Fatalf("unexpected collection: %+v", collection)
+		}
+		point := collection.Features[0].Geometry
+		if point == nil || point.Type != "Point" || point.Coordinates != [2]float64{2.17, 41.38} {
+			t.Fatalf("unexpected geometry: %+v", point)
+		}
+		if collection.Features[1].Geometry != nil {
+			t.Fatal("restaurants without coordinates must have a null geometry")
+		}
+	})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	importMaxRows            = 5000
+	importDefaultConcurrency = 4
+	importMaxConcurrency     = 16
+
+	importRowValid   = "valid"
+	importRowInvalid = "invalid"
+	importRowCreated = "created"
+	importRowFailed  = "failed"
+)
+
+type (
+	importRow struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Lat         string   `json:"lat"`
+		Lng         string   `json:"lng"`
+		Images      []string `json:"images"`
+	}
+
+	importImage struct {
+		mimeType string
+		data     []byte
+	}
+
+	importRowResult struct {
+		Row    int         `json:"row"`
+		Status string      `json:"status"`
+		Id     string      `json:"id,omitempty"`
+		Errors []string    `json:"errors,omitempty"`
+		Steps  []*sagaStep `json:"steps,omitempty"`
+	}
+
+	importReport struct {
+		DryRun    bool              `json:"dryRun"`
+		Total     int               `json:"total"`
+		Succeeded int               `json:"succeeded"`
+		Failed    int               `json:"failed"`
+		Rows      []importRowResult `json:"rows"`
+	}
+)
+
+// importRestaurants creates restaurants in bulk from a CSV or NDJSON document, sent
+// either as the request body or as the "data" part of a multipart form whose other
+// parts are the image files the rows reference by name.
+func importRestaurants(c *gin.Context) {
+	ctx := c.Request.Context()
+	dryRun := false
+	if q := c.Query("dryRun"); q != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(q); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+	}
+	concurrency := importDefaultConcurrency
+	if q := c.Query("concurrency"); q != "" {
+		value, err := strconv.Atoi(q)
+		if err != nil || value < 1 || value > importMaxConcurrency {
+			err = fmt.Errorf("query parameter 'concurrency' must be between 1 and %d", importMaxConcurrency)
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		concurrency = value
+	}
+
+	rows, images, err := readImportRequest(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if len(rows) > importMaxRows {
+		err := fmt.Errorf("an import can't have more than %d rows", importMaxRows)
+		c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+		panic(err)
+	}
+
+	report := importReport{DryRun: dryRun, Total: len(rows), Rows: make([]importRowResult, len(rows))}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for idx := range rows {
+		result := &report.Rows[idx]
+		result.Row = idx + 1
+		if errs := validateImportRow(rows[idx], images); len(errs) > 0 {
+			result.Status = importRowInvalid
+			result.Errors = errs
+			continue
+		}
+		if dryRun {
+			result.Status = importRowValid
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(row importRow) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			importRestaurant(ctx, row, images, result)
+		}(rows[idx])
+	}
+	wg.Wait()
+
+	for _, result := range report.Rows {
+		if result.Status == importRowValid || result.Status == importRowCreated {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// importRestaurant creates the restaurant of a single row, rolling the row back when
+// any of its steps fails.
+func importRestaurant(ctx context.Context, row importRow, images map[string]importImage, result *importRowResult) {
+	var tx saga
+	var r *restaurantApi
+	err := tx.run(ctx, "restaurant.create", func(ctx context.Context) (err error) {
+		r, err = AddRestaurant(ctx, restaurantApiPost{Name: row.Name, Description: row.Description})
+		return err
+	}, func(ctx context.Context) error {
+		return DeleteRestaurantById(ctx, r.Id)
+	})
+	if err == nil && row.Lat != "" {
+		err = tx.run(ctx, "restaurant.locate", func(ctx context.Context) (err error) {
+			lat, lng := row.Lat, row.Lng
+			r, err = UpdateRestaurant(ctx, r.Id, restaurantApi{restaurantApiPost: r.restaurantApiPost, Id: r.Id, Latitude: &lat, Longitude: &lng})
+			return err
+		}, nil)
+	}
+	for idx := 0; err == nil && idx < len(row.Images); idx++ {
+		image := images[row.Images[idx]]
+		var imgId string
+		err = tx.run(ctx, fmt.Sprintf("image[%d].upload", idx), func(ctx context.Context) (err error) {
+			imgId, err = AddImageToRestaurant(ctx, r.Id, image.mimeType, image.data)
+			return err
+		}, func(ctx context.Context) error {
+			return DeleteImage(ctx, imgId)
+		})
+	}
+	if err != nil {
+		tx.compensate(ctx)
+		result.Status = importRowFailed
+		result.Errors = []string{err.Error()}
+		result.Steps = tx.Steps
+		return
+	}
+	restaurantSearch.put(*r)
+	events.publish(eventRestaurantCreated, r.Id, newRestaurant(*r))
+	result.Status = importRowCreated
+	result.Id = r.Id
+}
+
+func validateImportRow(row importRow, images map[string]importImage) []string {
+	var errs []string
+	if strings.TrimSpace(row.Name) == "" {
+		errs = append(errs, "name is required")
+	}
+	if (row.Lat == "") != (row.Lng == "") {
+		errs = append(errs, "lat and lng must be given together")
+	}
+	if row.Lat != "" {
+		if lat, err := strconv.ParseFloat(row.Lat, 64); err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+			errs = append(errs, fmt.Sprintf("invalid lat '%s'", row.Lat))
+		}
+	}
+	if row.Lng != "" {
+		if lng, err := strconv.ParseFloat(row.Lng, 64); err != nil || math.IsNaN(lng) || lng < -180 || lng > 180 {
+			errs = append(errs, fmt.Sprintf("invalid lng '%s'", row.Lng))
+		}
+	}
+	for _, ref := range row.Images {
+		if _, ok := images[ref]; !ok {
+			errs = append(errs, fmt.Sprintf("image file '%s' was not uploaded", ref))
+		}
+	}
+	return errs
+}
+
+func readImportRequest(c *gin.Context) ([]importRow, map[string]importImage, error) {
+	images := map[string]importImage{}
+	contentType := c.ContentType()
+	if contentType != "multipart/form-data" {
+		rows, err := parseImportRows(contentType, c.Request.Body)
+		return rows, images, err
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, nil, err
+	}
+	if form.File["data"] == nil {
+		return nil, nil, errors.New("multipart import requires a 'data' part")
+	}
+	var rows []importRow
+	for field, headers := range form.File {
+		for _, header := range headers {
+			file, err := header.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			data, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			partType := header.Header.Get("Content-Type")
+			if field == "data" {
+				dataType, _, _ := mime.ParseMediaType(partType)
+				if dataType == "" || dataType == "application/octet-stream" {
+					dataType = importContentTypeByName(header.Filename)
+				}
+				if rows, err = parseImportRows(dataType, bytes.NewReader(data)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			if partType == "" || partType == "application/octet-stream" {
+				partType = http.DetectContentType(data)
+			}
+			images[header.Filename] = importImage{mimeType: partType, data: data}
+		}
+	}
+	return rows, images, nil
+}
+
+func importContentTypeByName(filename string) string {
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+func parseImportRows(contentType string, body io.Reader) ([]importRow, error) {
+	switch contentType {
+	case "text/csv":
+		return parseImportCsv(body)
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return parseImportNdjson(body)
+	default:
+		return nil, fmt.Errorf("unsupported import content type '%s'", contentType)
+	}
+}
+
+func parseImportCsv(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %v", err)
+	}
+	columns := map[string]int{}
+	for idx, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "name":
+			columns["name"] = idx
+		case "description":
+			columns["description"] = idx
+		case "lat", "latitude":
+			columns["lat"] = idx
+		case "lng", "lon", "longitude":
+			columns["lng"] = idx
+		case "images":
+			columns["images"] = idx
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("csv header must have a 'name' column")
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := func(column string) string {
+			if idx, ok := columns[column]; ok && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+		row := importRow{Name: value("name"), Description: value("description"), Lat: value("lat"), Lng: value("lng")}
+		for _, ref := range strings.Split(value("images"), ";") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				row.Images = append(row.Images, ref)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func parseImportNdjson(body io.Reader) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row struct {
+			importRow
+			Lat json.Number `json:"lat"`
+			Lng json.Number `json:"lng"`
+		}
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		row.importRow.Lat = row.Lat.String()
+		row.importRow.Lng = row.Lng.String()
+		rows = append(rows, row.importRow)
+	}
+	return rows, scanner.Err()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRestaurantImport(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("csv", func(t *testing.T) {
+		rows, err := parseImportCsv(strings.NewReader("Name,Description,Latitude,Longitude,Images\n" +
+			"\"Joe's Pizza\",\"Pizza, pasta\",41.38,2.17,front.jpg;menu.png\n" +
+			"Sushi Bar,,,,\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("expected 2 rows, got %d", len(rows))
+		}
+		if rows[0].Name != "Joe's Pizza" || rows[0].Description != "Pizza, pasta" || rows[0].Lat != "41.38" || len(rows[0].Images) != 2 {
+			t.Fatalf("unexpected row: %+v", rows[0])
+		}
+		if rows[1].Lat != "" || rows[1].Images != nil {
+			t.Fatalf("unexpected row: %+v", rows[1])
+		}
+	})
+
+	test.Run("ndjson", func(t *testing.T) {
+		rows, err := parseImportNdjson(strings.NewReader(`{"name":"Joe's Pizza","lat":41.38,"lng":"2.17"}` + "\n\n" + `{"name":"Sushi Bar"}` + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0].Lat != "41.38" || rows[0].Lng != "2.17" || rows[1].Lat != "" {
+			t.Fatalf("unexpected rows: %+v", rows)
+		}
+	})
+
+	test.Run("validation", func(t *testing.T) {
+		images := map[string]importImage{"front.jpg": {}}
+		if errs := validateImportRow(importRow{Name: "Joe's Pizza", Lat: "41.38", Lng: "2.17", Images: []string{"front.jpg"}}, images); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if errs := validateImportRow(importRow{Lat: "91", Images: []string{"menu.png"}}, images); len(errs) != 4 {
+			t.Fatalf("expected 4 errors, got %v", errs)
+		}
+		if errs := validateImportRow(importRow{Name: "Nowhere", Lat: "NaN", Lng: "nan"}, images); len(errs) != 2 {
+			t.Fatalf("expected 2 errors, got %v", errs)
+		}
+	})
+
+	test.Run("dry-run", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		data, _ := form.CreateFormFile("data", "restaurants.csv")
+		data.Write([]byte("name,lat,lng,images\nJoe's Pizza,41.38,2.17,front.jpg\n,95,2.17,\n"))
+		image, _ := form.CreateFormFile("front", "front.jpg")
+		image.Write([]byte{0xff, 0xd8, 0xff, 0xe0})
+		form.Close()
+
+		url := "/restaurants:import?dryRun=true"
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+		var report importReport
+		if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if !report.DryRun || report.Total != 2 || report.Succeeded != 1 || report.Failed != 1 {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+		if report.Rows[0].Status != importRowValid || report.Rows[1].Status != importRowInvalid {
+			t.Fatalf("unexpected rows: %+v", report.Rows)
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	liveMaxSubscriptions = 500
+	liveMaxMessageSize   = 64 * 1024
+	liveWriteTimeout     = 10 * time.Second
+	liveLookupTimeout    = 10 * time.Second
+	liveBacklog          = 16
+)
+
+type (
+	// liveRequest is a message sent by the client of a live connection.
+	liveRequest struct {
+		Type          string   `json:"type"`
+		RestaurantIds []string `json:"restaurantIds"`
+	}
+
+	// liveMessage is a message pushed to the client of a live connection.
+	liveMessage struct {
+		Type          string      `json:"type"`
+		RestaurantId  string      `json:"restaurantId,omitempty"`
+		RestaurantIds []string    `json:"restaurantIds,omitempty"`
+		Restaurant    *restaurant `json:"restaurant,omitempty"`
+		Error         string      `json:"error,omitempty"`
+	}
+
+	// liveConnection tracks the restaurants a websocket client is subscribed to. Changes
+	// are only recorded as pending restaurants and the aggregates are looked up when the
+	// client is ready for them, so a slow client gets the latest state of a restaurant
+	// once rather than every change in between.
+	liveConnection struct {
+		sync.Mutex
+		subscribed map[string]bool
+		pending    map[string]bool
+		deleted    map[string]bool
+		wake       chan struct{}
+		replies    chan liveMessage
+	}
+)
+
+var (
+	liveHeartbeat = 30 * time.Second
+	liveUpgrader  = websocket.Upgrader{CheckOrigin: liveCheckOrigin}
+	// liveEvents are the events that change the aggregate pushed to subscribers.
+	liveEvents = map[string]bool{
+		eventRestaurantUpdated:  true,
+		eventRestaurantRestored: true,
+		eventImageAdded:         true,
+		eventImageDeleted:       true,
+		eventRatingAdded:        true,
+		eventRatingUpdated:      true,
+		eventRatingDeleted:      true,
+	}
+)
+
+func newLiveConnection() *liveConnection {
+	return &liveConnection{
+		subscribed: map[string]bool{},
+		pending:    map[string]bool{},
+		deleted:    map[string]bool{},
+		wake:       make(chan struct{}, 1),
+		replies:    make(chan liveMessage, liveBacklog),
+	}
+}
+
+// liveCheckOrigin applies the CORS origin policy of the REST and SSE endpoints to live
+// connections, which browsers don't check themselves: the gateway's own origin and the
+// configured CORS origins are let in, or every origin when none are configured. Clients
+// that send no Origin aren't browsers and are let in.
+func liveCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return len(corsOrigins) == 0 || originAllowed(origin)
+}
+
+func getRestaurantsLive(c *gin.Context) {
+	conn, err := liveUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already answered the request
+		logError(c, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	live := newLiveConnection()
+	written := make(chan struct{})
+	go live.watchEvents(ctx)
+	go func() {
+		defer close(written)
+		live.write(ctx, c, conn)
+	}()
+	// the writer uses the gin context, which must not outlive the handler
+	defer func() {
+		cancel()
+		conn.Close()
+		<-written
+	}()
+
+	conn.SetReadLimit(liveMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * liveHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * liveHeartbeat))
+	})
+	for {
+		var rq liveRequest
+		if err := conn.ReadJSON(&rq); err != nil {
+			// closed by the client, missed heartbeat or malformed message
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * liveHeartbeat))
+		if !live.handle(rq) {
+			// the client doesn't read its replies, there is no point in going on
+			return
+		}
+	}
+}
+
+// handle applies a client request and queues its reply. It returns false when the
+// reply can't be queued.
+func (l *liveConnection) handle(rq liveRequest) bool {
+	var reply liveMessage
+	switch rq.Type {
+	case "subscribe":
+		if err := l.subscribe(rq.RestaurantIds); err != nil {
+			reply = liveMessage{Type: "error", Error: err.Error()}
+		} else {
+			reply = liveMessage{Type: "subscribed", RestaurantIds: rq.RestaurantIds}
+		}
+	case "unsubscribe":
+		l.unsubscribe(rq.RestaurantIds)
+		reply = liveMessage{Type: "unsubscribed", RestaurantIds: rq.RestaurantIds}
+	case "ping":
+		reply = liveMessage{Type: "pong"}
+	default:
+		reply = liveMessage{Type: "error", Error: fmt.Sprintf("unknown message type '%s'", rq.Type)}
+	}
+	select {
+	case l.replies <- reply:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribe adds restaurants to the subscription and marks them as pending, so their
+// current state is sent right away.
+func (l *liveConnection) subscribe(restaurantIds []string) error {
+	l.Lock()
+	defer l.Unlock()
+	added := 0
+	for _, id := range restaurantIds {
+		if !l.subscribed[id] {
+			added++
+		}
+	}
+	if len(l.subscribed)+added > liveMaxSubscriptions {
+		return fmt.Errorf("a connection can't subscribe to more than %d restaurants", liveMaxSubscriptions)
+	}
+	for _, id := range restaurantIds {
+		if id == "" {
+			continue
+		}
+		l.subscribed[id] = true
+		l.pending[id] = true
+	}
+	l.notify()
+	return nil
+}
+
+func (l *liveConnection) unsubscribe(restaurantIds []string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, id := range restaurantIds {
+		delete(l.subscribed, id)
+		delete(l.pending, id)
+		delete(l.deleted, id)
+	}
+}
+
+// watchEvents marks the subscribed restaurants as pending as their events come in.
+func (l *liveConnection) watchEvents(ctx context.Context) {
+	for {
+		sub, _ := events.subscribe(-1)
+		l.watchSubscription(ctx, sub)
+		events.unsubscribe(sub)
+		if ctx.Err() != nil {
+			return
+		}
+		// the broker dropped us for falling behind, resend everything
+		l.Lock()
+		for id := range l.subscribed {
+			l.pending[id] = true
+		}
+		l.notify()
+		l.Unlock()
+	}
+}
+
+func (l *liveConnection) watchSubscription(ctx context.Context, sub chan event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub:
+			if !ok {
+				return
+			}
+			l.apply(e)
+		}
+	}
+}
+
+func (l *liveConnection) apply(e event) {
+	l.Lock()
+	defer l.Unlock()
+	if !l.subscribed[e.RestaurantId] {
+		return
+	}
+	switch {
+	case e.Type == eventRestaurantDeleted:
+		delete(l.pending, e.RestaurantId)
+		l.deleted[e.RestaurantId] = true
+	case liveEvents[e.Type]:
+		delete(l.deleted, e.RestaurantId)
+		l.pending[e.RestaurantId] = true
+	default:
+		return
+	}
+	l.notify()
+}
+
+func (l *liveConnection) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns and clears the restaurants whose state has to be sent.
+func (l *liveConnection) takePending() (updated []string, deleted []string) {
+	l.Lock()
+	defer l.Unlock()
+	for id := range l.pending {
+		updated = append(updated, id)
+	}
+	for id := range l.deleted {
+		deleted = append(deleted, id)
+	}
+	l.pending = map[string]bool{}
+	l.deleted = map[string]bool{}
+	return updated, deleted
+}
+
+// write is the only writer of the connection, it sends the replies, the pending
+// restaurants and the heartbeats.
+func (l *liveConnection) write(ctx context.Context, c *gin.Context, conn *websocket.Conn) {
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	// a client that doesn't keep up with the writes is disconnected, which also ends
+	// the read loop
+	defer conn.Close()
+	send := func(msg liveMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		return conn.WriteJSON(msg) == nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-l.replies:
+			if !send(msg) {
+				return
+			}
+		case <-l.wake:
+			updated, deleted := l.takePending()
+			for _, id := range deleted {
+				if !send(liveMessage{Type: "deleted", RestaurantId: id}) {
+					return
+				}
+			}
+			for _, id := range updated {
+				msg := liveMessage{Type: "restaurant", RestaurantId: id}
+				rest, err := loadRestaurant(ctx, c, id)
+				if err != nil {
+					msg = liveMessage{Type: "error", RestaurantId: id, Error: err.Error()}
+				} else if rest == nil {
+					msg = liveMessage{Type: "deleted", RestaurantId: id}
+				} else {
+					msg.Restaurant = rest
+				}
+				if !send(msg) {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// loadRestaurant looks up a restaurant together with its images and rating. It returns
+// nil for a restaurant in the trash.
+func loadRestaurant(ctx context.Context, c *gin.Context, restaurantId string) (*restaurant, error) {
+	if trash.contains(restaurantId) {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, liveLookupTimeout)
+	defer cancel()
+	r, err := GetRestaurantById(ctx, restaurantId)
+	if err != nil {
+		return nil, err
+	}
+	rest := newRestaurant(*r)
+	imgs, err := GetImagesByRestaurant(ctx, restaurantId)
+	if err != nil {
+		logError(c, err)
+	}
+	for _, item := range imgs {
+		rest.Images = append(rest.Images, fmt.Sprintf("/images/%s", item))
+	}
+	if rest.Rating, err = restaurantRating(ctx, restaurantId); err != nil {
+		logError(c, err)
+	}
+	return &rest, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"go.undefinedlabs.com/scopeagent"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestaurantsLive(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("subscriptions", func(t *testing.T) {
+		live := newLiveConnection()
+		if err := live.subscribe([]string{"1", "2"}); err != nil {
+			t.Fatal(err)
+		}
+		if updated, _ := live.takePending(); len(updated) != 2 {
+			t.Fatalf("subscribed restaurants not sent: %v", updated)
+		}
+
+		live.apply(event{Type: eventRatingAdded, RestaurantId: "1"})
+		live.apply(event{Type: eventImageAdded, RestaurantId: "1"})
+		live.apply(event{Type: eventRatingAdded, RestaurantId: "3"})
+		live.apply(event{Type: eventRestaurantDeleted, RestaurantId: "2"})
+		updated, deleted := live.takePending()
+		if len(updated) != 1 || updated[0] != "1" || len(deleted) != 1 || deleted[0] != "2" {
+			t.Fatalf("unexpected pending restaurants: %v %v", updated, deleted)
+		}
+
+		live.unsubscribe([]string{"1"})
+		live.apply(event{Type: eventRatingAdded, RestaurantId: "1"})
+		if updated, _ := live.takePending(); len(updated) != 0 {
+			t.Fatalf("unsubscribed restaurant sent: %v", updated)
+		}
+	})
+
+	test.Run("limit", func(t *testing.T) {
+		live := newLiveConnection()
+		ids := make([]string, liveMaxSubscriptions+1)
+		for i := range ids {
+			ids[i] = strings.Repeat("x", i+1)
+		}
+		if err := live.subscribe(ids); err == nil {
+			t.Fatal("subscription limit not enforced")
+		}
+	})
+
+	test.Run("origin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://gateway.test/restaurants/live", nil)
+		req.Header.Set("Origin", "https://evil.example.net")
+		if !liveCheckOrigin(req) {
+			t.Fatal("origin refused without configured CORS origins")
+		}
+
+		corsOrigins = []string{"https://app.example.com", "https://*.example.org"}
+		defer func() { corsOrigins = nil }()
+		for origin, allowed := range map[string]bool{
+			"":                                 true,
+			"http://gateway.test":              true,
+			"https://app.example.com":          true,
+			"https://shop.example.org":         true,
+			"https://evil.example.net":         false,
+			"https://app.example.com.evil.net": false,
+		} {
+			req := httptest.NewRequest("GET", "http://gateway.test/restaurants/live", nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			if liveCheckOrigin(req) != allowed {
+				t.Fatalf("origin '%s' allowed: %v", origin, !allowed)
+			}
+		}
+	})
+
+	test.Run("protocol", func(t *testing.T) {
+		srv := httptest.NewServer(router)
+		defer srv.Close()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/restaurants/live", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		for _, c := range []struct {
+			rq    liveRequest
+			reply string
+		}{
+			{liveRequest{Type: "ping"}, "pong"},
+			{liveRequest{Type: "unsubscribe", RestaurantIds: []string{"1"}}, "unsubscribed"},
+			{liveRequest{Type: "nope"}, "error"},
+		} {
+			if err := conn.WriteJSON(c.rq); err != nil {
+				t.Fatal(err)
+			}
+			var msg liveMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != c.reply {
+				t.Fatalf("expected %s, got %+v", c.reply, msg)
+			}
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	searchNameWeight        = 3.0
+	searchDescriptionWeight = 1.0
+	searchPrefixPenalty     = 0.7
+	searchFuzzyPenalty      = 0.5
+	searchDefaultLimit      = 20
+)
+
+type (
+	searchIndex struct {
+		sync.RWMutex
+		seeded   bool
+		docs     map[string]searchDocument
+		postings map[string]map[string]*searchPosting
+		terms    []string
+		dirty    bool
+	}
+
+	searchDocument struct {
+		restaurant restaurantApi
+		terms      []string
+	}
+
+	searchPosting struct {
+		name        int
+		description int
+	}
+
+	searchHit struct {
+		restaurantApi
+		Score float64 `json:"score"`
+	}
+)
+
+var restaurantSearch = newSearchIndex()
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     map[string]searchDocument{},
+		postings: map[string]map[string]*searchPosting{},
+	}
+}
+
+func searchRestaurants(c *gin.Context) {
+	ctx := c.Request.Context()
+	query := c.Query("q")
+	if strings.TrimSpace(query) == "" {
+		err := errors.New("query parameter 'q' is required")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	limit := searchDefaultLimit
+	if l := c.Query("limit"); l != "" {
+		value, err := strconv.Atoi(l)
+		if err != nil || value <= 0 {
+			err = errors.New("query parameter 'limit' must be a positive integer")
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		limit = value
+	}
+	if err := restaurantSearch.seed(ctx); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, restaurantSearch.search(query, limit))
+}
+
+// seed fills the index from the restaurant service the first time it's used, after
+// that listings and the gateway's own handlers keep it current.
+func (idx *searchIndex) seed(ctx context.Context) error {
+	idx.RLock()
+	seeded := idx.seeded
+	idx.RUnlock()
+	if seeded {
+		return nil
+	}
+	rests, err := GetAllRestaurants(ctx)
+	if err != nil {
+		return err
+	}
+	idx.replaceAll(trash.filter(rests))
+	return nil
+}
+
+func (idx *searchIndex) put(rests ...restaurantApi) {
+	idx.Lock()
+	defer idx.Unlock()
+	for _, r := range rests {
+		idx.putLocked(r)
+	}
+}
+
+func (idx *searchIndex) replaceAll(rests []restaurantApi) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.docs = map[string]searchDocument{}
+	idx.postings = map[string]map[string]*searchPosting{}
+	idx.dirty = true
+	for _, r := range rests {
+		idx.putLocked(r)
+	}
+	idx.seeded = true
+}
+
+func (idx *searchIndex) remove(restaurantId string) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeLocked(restaurantId)
+}
+
+func (idx *searchIndex) putLocked(r restaurantApi) {
+	if r.Id == "" {
+		return
+	}
+	idx.removeLocked(r.Id)
+	doc := searchDocument{restaurant: r}
+	add := func(text string, field func(*searchPosting)) {
+		for _, term := range tokenize(text) {
+			docs, ok := idx.postings[term]
+			if !ok {
+				docs = map[string]*searchPosting{}
+				idx.postings[term] = docs
+				idx.dirty = true
+			}
+			posting, ok := docs[r.Id]
+			if !ok {
+				posting = &searchPosting{}
+				docs[r.Id] = posting
+				doc.terms = append(doc.terms, term)
+			}
+			field(posting)
+		}
+	}
+	add(r.Name, func(p *searchPosting) { p.name++ })
+	add(r.Description, func(p *searchPosting) { p.description++ })
+	idx.docs[r.Id] = doc
+}
+
+func (idx *searchIndex) removeLocked(restaurantId string) {
+	doc, ok := idx.docs[restaurantId]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(idx.postings[term], restaurantId)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+			idx.dirty = true
+		}
+	}
+	delete(idx.docs, restaurantId)
+}
+
+func (idx *searchIndex) search(query string, limit int) []searchHit {
+	idx.Lock()
+	if idx.dirty {
+		idx.terms = idx.terms[:0]
+		for term := range idx.postings {
+			idx.terms = append(idx.terms, term)
+		}
+		sort.Strings(idx.terms)
+		idx.dirty = false
+	}
+	idx.Unlock()
+
+	idx.RLock()
+	defer idx.RUnlock()
+
+	scores := map[string]float64{}
+	total := float64(len(idx.docs))
+	for _, token := range tokenize(query) {
+		// every query token contributes only its best matching term per restaurant
+		best := map[string]float64{}
+		for term, penalty := range idx.expand(token) {
+			docs := idx.postings[term]
+			df := float64(len(docs))
+			idf := math.Log(1 + (total-df+0.5)/(df+0.5))
+			for id, posting := range docs {
+				tf := searchNameWeight*float64(posting.name) + searchDescriptionWeight*float64(posting.description)
+				score := penalty * idf * tf / (tf + 1.2)
+				if score > best[id] {
+					best[id] = score
+				}
+			}
+		}
+		for id, score := range best {
+			scores[id] += score
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{restaurantApi: idx.docs[id].restaurant, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// expand returns the indexed terms a query token matches, exactly, as a prefix or
+// within a small edit distance, together with the weight of that kind of match.
+func (idx *searchIndex) expand(token string) map[string]float64 {
+	matches := map[string]float64{}
+	if _, ok := idx.postings[token]; ok {
+		matches[token] = 1
+	}
+	if len([]rune(token)) >= 2 {
+		for i := sort.SearchStrings(idx.terms, token); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], token); i++ {
+			if _, ok := matches[idx.terms[i]]; !ok {
+				matches[idx.terms[i]] = searchPrefixPenalty
+			}
+		}
+	}
+	maxEdits := fuzzyMaxEdits(token)
+	if maxEdits == 0 {
+		return matches
+	}
+	tokenLen := len([]rune(token))
+	for _, term := range idx.terms {
+		if _, ok := matches[term]; ok {
+			continue
+		}
+		termLen := len([]rune(term))
+		if termLen-tokenLen > maxEdits || tokenLen-termLen > maxEdits {
+			continue
+		}
+		if d := levenshtein(token, term); d <= maxEdits {
+			matches[term] = searchFuzzyPenalty / float64(d)
+		}
+	}
+	return matches
+}
+
+func fuzzyMaxEdits(token string) int {
+	switch n := len([]rune(token)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func tokenize(text string) []string {
+	text = strings.NewReplacer("'", "", "’", "").Replace(strings.ToLower(text))
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
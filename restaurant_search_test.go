@@ -0,0 +1,59 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"testing"
+)
+
+func TestRestaurantSearchIndex(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	idx := newSearchIndex()
+	idx.replaceAll([]restaurantApi{
+		{Id: "1", restaurantApiPost: restaurantApiPost{Name: "Joe's Pizza", Description: "Wood fired pizza and pasta"}},
+		{Id: "2", restaurantApiPost: restaurantApiPost{Name: "Pasta Palace", Description: "Fresh pasta every day"}},
+		{Id: "3", restaurantApiPost: restaurantApiPost{Name: "Sushi Bar", Description: "Nigiri and maki"}},
+	})
+
+	test.Run("exact", func(t *testing.T) {
+		hits := idx.search("pasta", 10)
+		if len(hits) != 2 {
+			t.Fatalf("expected 2 hits, got %d", len(hits))
+		}
+		if hits[0].Id != "2" {
+			t.Fatalf("expected the restaurant named after the term first, got %s", hits[0].Id)
+		}
+	})
+
+	test.Run("prefix", func(t *testing.T) {
+		hits := idx.search("sus", 10)
+		if len(hits) != 1 || hits[0].Id != "3" {
+			t.Fatalf("unexpected hits: %v", hits)
+		}
+	})
+
+	test.Run("fuzzy", func(t *testing.T) {
+		hits := idx.search("piza", 10)
+		if len(hits) != 1 || hits[0].Id != "1" {
+			t.Fatalf("unexpected hits: %v", hits)
+		}
+	})
+
+	test.Run("apostrophe", func(t *testing.T) {
+		hits := idx.search("joes", 10)
+		if len(hits) != 1 || hits[0].Id != "1" {
+			t.Fatalf("unexpected hits: %v", hits)
+		}
+	})
+
+	test.Run("update-remove", func(t *testing.T) {
+		idx.put(restaurantApi{Id: "3", restaurantApiPost: restaurantApiPost{Name: "Ramen House"}})
+		if hits := idx.search("sushi", 10); len(hits) != 0 {
+			t.Fatalf("stale terms after update: %v", hits)
+		}
+		idx.remove("3")
+		if hits := idx.search("ramen", 10); len(hits) != 0 {
+			t.Fatalf("removed restaurant still found: %v", hits)
+		}
+	})
+}
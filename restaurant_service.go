@@ -10,6 +10,8 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,8 +20,11 @@ import (
 type (
 	restaurant struct {
 		restaurantApi
-		Rating *float64 `json:"rating"`
-		Images []string `json:"images"`
+		Slug        string   `json:"slug,omitempty"`
+		Rating      *float64 `json:"rating"`
+		ReviewCount int      `json:"reviewCount"`
+		Tags        []string `json:"tags"`
+		Images      []string `json:"images"`
 	}
 
 	restaurantApi struct {
@@ -36,38 +41,103 @@ type (
 
 	restaurantPost struct {
 		restaurantApiPost
-		Images *[]restaurantPostImage `json:"images"`
+		Latitude  *string                `json:"latitude"`
+		Longitude *string                `json:"longitude"`
+		Images    *[]restaurantPostImage `json:"images"`
 	}
 
 	restaurantPostImage struct {
 		MimeType string `json:"mimeType"`
 		Data     []byte `json:"data"`
 	}
+
+	// restaurantCreated is a restaurant created without some of its parts, with the
+	// steps of the creation telling which ones failed.
+	restaurantCreated struct {
+		restaurant
+		Steps []*sagaStep `json:"steps"`
+	}
 )
 
 var (
-	restaurantApiUrl = "https://java-demo-app.undefinedlabs.dev/"
-	counter          int64
+	restaurantApiUrl         = "https://java-demo-app.undefinedlabs.dev/"
+	counter                  int64
+	atomicRestaurantCreation = false
+
+	// restaurantSubRoutes holds the fixed paths below /restaurants/ that gin's router
+	// can't register next to the :restaurantId wildcard.
+	restaurantSubRoutes = map[string]gin.HandlerFunc{}
+	// restaurantCustomMethods holds the "/restaurants:method" endpoints, which gin's
+	// router would take for a path parameter, keyed by request method and path.
+	restaurantCustomMethods = map[string]gin.HandlerFunc{}
+
+	errRestaurantNotFound = errors.New("restaurant not found")
 )
 
 func init() {
 	if svc, ok := os.LookupEnv("APP_RESTAURANT_SVC"); ok {
 		restaurantApiUrl = svc
 	}
+	if value, ok := os.LookupEnv("APP_ATOMIC_RESTAURANT_CREATION"); ok {
+		atomicRestaurantCreation, _ = strconv.ParseBool(value)
+	}
 }
 
 func addRestaurantServiceEndpoints(r *gin.Engine) {
 	r.GET("/restaurants", getRestaurants)
-	r.GET("/restaurants/:restaurantId", getRestaurantById)
-	r.POST("/restaurants", postRestaurant)
+	r.GET("/restaurants/:restaurantId", getRestaurantByIdOrSubRoute)
+	r.POST("/restaurants", idempotencyMiddleware, postRestaurant)
 	r.PATCH("/restaurants/:restaurantId", patchRestaurant)
 	r.DELETE("/restaurants/:restaurantId", deleteRestaurant)
+	r.POST("/restaurants/:restaurantId/restore", restoreRestaurant)
+	r.GET("/restaurants/:restaurantId/similar", getSimilarRestaurants)
+	restaurantSubRoutes["search"] = searchRestaurants
+	restaurantSubRoutes["trash"] = getRestaurantTrash
+	restaurantSubRoutes["live"] = getRestaurantsLive
+	restaurantSubRoutes["top"] = getTopRestaurants
+	restaurantCustomMethods["POST /restaurants:import"] = importRestaurants
+	restaurantCustomMethods["GET "+exportPath] = exportRestaurants
+	r.NoRoute(routeRestaurantCustomMethod)
+}
+
+func getRestaurantByIdOrSubRoute(c *gin.Context) {
+	if handler, ok := restaurantSubRoutes[c.Param("restaurantId")]; ok {
+		handler(c)
+		return
+	}
+	getRestaurantById(c)
+}
+
+func routeRestaurantCustomMethod(c *gin.Context) {
+	if handler, ok := restaurantCustomMethods[c.Request.Method+" "+c.Request.URL.Path]; ok {
+		c.Status(http.StatusOK)
+		handler(c)
+		return
+	}
+	// /restaurants/by-slug/:slug would clash with the /restaurants/:restaurantId/... routes
+	if c.Request.Method == "GET" && strings.HasPrefix(c.Request.URL.Path, slugRoutePrefix) {
+		c.Status(http.StatusOK)
+		getRestaurantBySlug(c)
+	}
 }
 
 func getRestaurants(c *gin.Context) {
 	ctx := c.Request.Context()
+	view, err := parseRestaurantView(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	var required []string
+	for _, q := range c.QueryArray("tag") {
+		required = append(required, splitQueryList(q)...)
+	}
+	required, err = tagsVocabulary.resolve(required)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
 	var r []restaurantApi
-	var err error
 	if c.Query("name") != "" {
 		r, err = GetAllRestaurantsByName(ctx, c.Query("name"))
 	} else {
@@ -77,49 +147,81 @@ func getRestaurants(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
-	rests := make([]restaurant, 0)
+	r = trash.filter(r)
+	if c.Query("name") != "" {
+		restaurantSearch.put(r...)
+	} else {
+		restaurantSearch.replaceAll(r)
+	}
+	if len(required) > 0 {
+		r = tags.filter(r, required)
+	}
+	body, err := view.renderAll(lookupRestaurants(c, r, view))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// lookupRestaurants builds the aggregates of the restaurants, fetching the images and
+// ratings the view asks for concurrently. Failed lookups are logged and left empty.
+func lookupRestaurants(c *gin.Context, r []restaurantApi, view restaurantView) []restaurant {
+	ctx := c.Request.Context()
+	rests := make([]restaurant, 0, len(r))
 	var wg sync.WaitGroup
-	wg.Add(len(r) * 2)
 
 	for idx := range r {
-		rests = append(rests, restaurant{restaurantApi: r[idx]})
-
-		go func(index int) {
-			defer wg.Done()
-
-			imgs, err := GetImagesByRestaurant(ctx, r[index].Id)
-			if err != nil {
-				c.Error(err)
-				logError(c, err)
-			}
-			for _, item := range imgs {
-				rests[index].Images = append(rests[index].Images, fmt.Sprintf("/images/%s", item))
-			}
+		rests = append(rests, newRestaurant(r[idx]))
+
+		if view.images {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+
+				imgs, err := GetImagesByRestaurant(ctx, r[index].Id)
+				if err != nil {
+					c.Error(err)
+					logError(c, err)
+				}
+				for _, item := range imgs {
+					rests[index].Images = append(rests[index].Images, fmt.Sprintf("/images/%s", item))
+				}
+
+			}(idx)
+		}
 
-		}(idx)
+		if view.rating {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
 
-		go func(index int) {
-			defer wg.Done()
+				rating, err := restaurantRating(ctx, r[index].Id)
+				if err != nil {
+					c.Error(err)
+					logError(c, err)
+				}
+				rests[index].Rating = rating
 
-			rating, err := GetRatingByRestaurantId(ctx, r[index].Id)
-			if err != nil {
-				c.Error(err)
-				logError(c, err)
-			}
-			rests[index].Rating = rating
-
-		}(idx)
+			}(idx)
+		}
 
 	}
 
 	wg.Wait()
-	c.JSON(http.StatusOK, rests)
+	return rests
 }
 
 func getRestaurantById(c *gin.Context) {
+	view, err := parseRestaurantView(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
 	ctx, cancel := context.WithTimeout(c.Request.Context(), getTimeoutDuration())
 	defer cancel()
 	restaurantId := c.Param("restaurantId")
+	abortIfTrashed(c, restaurantId)
 
 	var r *restaurantApi
 	var rErr error
@@ -129,19 +231,25 @@ func getRestaurantById(c *gin.Context) {
 	var ratingErr error
 	var wg sync.WaitGroup
 
-	wg.Add(3)
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		r, rErr = GetRestaurantById(ctx, restaurantId)
 	}()
-	go func() {
-		defer wg.Done()
-		imgs, imgsErr = GetImagesByRestaurant(ctx, restaurantId)
-	}()
-	go func() {
-		defer wg.Done()
-		rating, ratingErr = GetRatingByRestaurantId(ctx, restaurantId)
-	}()
+	if view.images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			imgs, imgsErr = GetImagesByRestaurant(ctx, restaurantId)
+		}()
+	}
+	if view.rating {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rating, ratingErr = restaurantRating(ctx, restaurantId)
+		}()
+	}
 
 	wg.Wait()
 
@@ -157,12 +265,19 @@ func getRestaurantById(c *gin.Context) {
 		c.Error(ratingErr)
 		panic(ratingErr)
 	}
-	var rest = restaurant{restaurantApi: *r}
+	restaurantSearch.put(*r)
+	var rest = newRestaurant(*r)
 	for _, item := range imgs {
 		rest.Images = append(rest.Images, fmt.Sprintf("/images/%s", item))
 	}
 	rest.Rating = rating
-	c.JSON(http.StatusOK, rest)
+	body, err := view.render(rest)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Header("ETag", restaurantETag(*r))
+	c.JSON(http.StatusOK, body)
 }
 
 func postRestaurant(c *gin.Context) {
@@ -173,34 +288,139 @@ func postRestaurant(c *gin.Context) {
 		c.AbortWithError(http.StatusBadRequest, err)
 		panic(err)
 	}
-	r, err := AddRestaurant(ctx, restRq.restaurantApiPost)
+	atomicCreate := atomicRestaurantCreation
+	if q := c.Query("atomic"); q != "" {
+		if atomicCreate, err = strconv.ParseBool(q); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+	}
+	force := false
+	if q := c.Query("force"); q != "" {
+		if force, err = strconv.ParseBool(q); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+	}
+	located := restaurantApi{restaurantApiPost: restRq.restaurantApiPost, Latitude: restRq.Latitude, Longitude: restRq.Longitude}
+	if (restRq.Latitude != nil || restRq.Longitude != nil) && !validCoordinates(located) {
+		err := errors.New("latitude and longitude must be given together as valid coordinates")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if !force {
+		candidates, err := findDuplicateRestaurants(ctx, located)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			panic(err)
+		}
+		if len(candidates) > 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error":      "restaurant may already exist, retry with force=true to create it anyway",
+				"candidates": candidates,
+			})
+			return
+		}
+	}
+
+	var tx saga
+	var r *restaurantApi
+	err = tx.run(ctx, "restaurant.create", func(ctx context.Context) (err error) {
+		r, err = AddRestaurant(ctx, restRq.restaurantApiPost)
+		return err
+	}, func(ctx context.Context) error {
+		return DeleteRestaurantById(ctx, r.Id)
+	})
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
-	var rest = restaurant{restaurantApi: *r}
+	// stepFailed reports whether the creation was rolled back because of a failed step
+	partial := false
+	stepFailed := func(err error) bool {
+		c.Error(err)
+		logError(c, err)
+		if !atomicCreate {
+			partial = true
+			return false
+		}
+		if !tx.compensate(ctx) {
+			err := fmt.Errorf("restaurant %s: creation could not be rolled back", r.Id)
+			c.Error(err)
+			logError(c, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error":        "restaurant creation failed and could not be fully rolled back",
+				"restaurantId": r.Id,
+				"steps":        tx.Steps,
+			})
+			return true
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "restaurant creation was rolled back",
+			"steps": tx.Steps,
+		})
+		return true
+	}
+	if restRq.Latitude != nil {
+		err := tx.run(ctx, "restaurant.locate", func(ctx context.Context) error {
+			updated, err := UpdateRestaurant(ctx, r.Id, restaurantApi{restaurantApiPost: r.restaurantApiPost, Id: r.Id, Latitude: restRq.Latitude, Longitude: restRq.Longitude})
+			if err == nil {
+				r = updated
+			}
+			return err
+		}, nil)
+		if err != nil && stepFailed(err) {
+			return
+		}
+	}
+	var images []string
 	if restRq.Images != nil {
-		for _, item := range *restRq.Images {
-			imgId, err := AddImageToRestaurant(ctx, rest.Id, item.MimeType, item.Data)
+		for idx, item := range *restRq.Images {
+			var imgId string
+			err := tx.run(ctx, fmt.Sprintf("image[%d].upload", idx), func(ctx context.Context) (err error) {
+				imgId, err = AddImageToRestaurant(ctx, r.Id, item.MimeType, item.Data)
+				return err
+			}, func(ctx context.Context) error {
+				return DeleteImage(ctx, imgId)
+			})
 			if err != nil {
-				c.Error(err)
-				logError(c, err)
+				if stepFailed(err) {
+					return
+				}
+				continue
 			}
-			rest.Images = append(rest.Images, fmt.Sprintf("/images/%s", imgId))
+			images = append(images, fmt.Sprintf("/images/%s", imgId))
 		}
 	}
+	restaurantSearch.put(*r)
+	rest := newRestaurant(*r)
+	rest.Images = images
+	events.publish(eventRestaurantCreated, r.Id, rest)
+	if partial {
+		c.JSON(http.StatusMultiStatus, restaurantCreated{restaurant: rest, Steps: tx.Steps})
+		return
+	}
 	c.JSON(http.StatusOK, rest)
 }
 
 func patchRestaurant(c *gin.Context) {
 	ctx := c.Request.Context()
 	restaurantId := c.Param("restaurantId")
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	abortIfTrashed(c, restaurantId)
+	current := checkRestaurantPreconditions(c, restaurantId)
 
 	var restRq restaurantApi
-	err := c.BindJSON(&restRq)
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		panic(err)
+	switch c.ContentType() {
+	case mergePatchContentType, jsonPatchContentType:
+		restRq = patchCurrentRestaurant(c, restaurantId, current)
+	default:
+		err := c.BindJSON(&restRq)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
 	}
 
 	r, err := UpdateRestaurant(ctx, restaurantId, restRq)
@@ -208,8 +428,9 @@ func patchRestaurant(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
+	restaurantSearch.put(*r)
 
-	rest := restaurant{restaurantApi: *r}
+	rest := newRestaurant(*r)
 	imgs, err := GetImagesByRestaurant(ctx, r.Id)
 	if err != nil {
 		c.Error(err)
@@ -218,26 +439,145 @@ func patchRestaurant(c *gin.Context) {
 	for _, item := range imgs {
 		rest.Images = append(rest.Images, fmt.Sprintf("/images/%s", item))
 	}
+	events.publish(eventRestaurantUpdated, r.Id, rest)
+	c.Header("ETag", restaurantETag(*r))
 	c.JSON(http.StatusOK, rest)
 }
 
+// patchCurrentRestaurant applies a merge patch or a JSON patch body to the restaurant
+// as the restaurant service currently has it.
+func patchCurrentRestaurant(c *gin.Context, restaurantId string, current *restaurantApi) restaurantApi {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	var ops []jsonPatchOperation
+	if c.ContentType() == jsonPatchContentType {
+		ops, err = decodeJsonPatch(body)
+	} else {
+		_, err = decodeJsonValue(body)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+
+	if current == nil {
+		current, err = GetRestaurantById(c.Request.Context(), restaurantId)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			panic(err)
+		}
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if ops != nil {
+		doc, err = applyJsonPatch(doc, ops)
+	} else {
+		doc, err = applyMergePatch(doc, body)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusConflict, err)
+		panic(err)
+	}
+	var patched restaurantApi
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		c.AbortWithError(http.StatusUnprocessableEntity, err)
+		panic(err)
+	}
+	patched.Id = restaurantId
+	return patched
+}
+
 func deleteRestaurant(c *gin.Context) {
 	ctx := c.Request.Context()
 	restaurantId := c.Param("restaurantId")
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	abortIfTrashed(c, restaurantId)
+	current := checkRestaurantPreconditions(c, restaurantId)
+
+	if softDeleteEnabled() {
+		var err error
+		if current == nil {
+			current, err = GetRestaurantById(ctx, restaurantId)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				panic(err)
+			}
+		}
+		if err = trash.add(*current); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			panic(err)
+		}
+		restaurantSearch.remove(restaurantId)
+		events.publish(eventRestaurantDeleted, restaurantId, nil)
+		return
+	}
 
 	err := DeleteRestaurantById(ctx, restaurantId)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		panic(err)
 	}
+	forgetRestaurant(restaurantId)
+	events.publish(eventRestaurantDeleted, restaurantId, nil)
 
-	err = DeleteImagesByRestaurant(ctx, restaurantId)
+	err = imageCleanup.deleteRestaurantImages(ctx, restaurantId)
 	if err != nil {
 		c.Error(err)
 		logError(c, err)
 	}
 }
 
+// newRestaurant starts the aggregate of a restaurant with the data the gateway keeps
+// itself, leaving the downstream lookups to the caller.
+func newRestaurant(r restaurantApi) restaurant {
+	return restaurant{restaurantApi: r, Slug: slugs.assign(r), ReviewCount: reviews.count(r.Id), Tags: tags.of(r.Id)}
+}
+
+// forgetRestaurant drops what the gateway keeps about a restaurant that was deleted
+// for good.
+func forgetRestaurant(restaurantId string) {
+	restaurantSearch.remove(restaurantId)
+	slugs.remove(restaurantId)
+	ratings.remove(restaurantId)
+	reviews.removeRestaurant(restaurantId)
+	ratingHistory.remove(restaurantId)
+	favorites.removeRestaurant(restaurantId)
+	tags.remove(restaurantId)
+	topRestaurants.remove(restaurantId)
+	restaurantSimilarities.remove(restaurantId)
+}
+
+func abortIfTrashed(c *gin.Context, restaurantId string) {
+	if trash.contains(restaurantId) {
+		err := errors.New("restaurant was deleted")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+}
+
+// requireRestaurant returns the restaurant, aborting with 404 when it was deleted or
+// the restaurant service doesn't know it.
+func requireRestaurant(c *gin.Context, restaurantId string) *restaurantApi {
+	abortIfTrashed(c, restaurantId)
+	r, err := GetRestaurantById(c.Request.Context(), restaurantId)
+	if err == errRestaurantNotFound {
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	return r
+}
+
 func GetAllRestaurants(ctx context.Context) ([]restaurantApi, error) {
 	url, err := getUrl(restaurantApiUrl, "restaurants")
 	if err != nil {
@@ -276,6 +616,9 @@ func GetRestaurantById(ctx context.Context, restaurantId string) (*restaurantApi
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRestaurantNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, errors.New(fmt.Sprintf("server: %s respond: %d: %s", url, resp.StatusCode, resp.Status))
 	}
@@ -325,6 +668,9 @@ func DeleteRestaurantById(ctx context.Context, restaurantId string) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return errRestaurantNotFound
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
 		return errors.New(fmt.Sprintf("server: %s respond: %d: %s", url, resp.StatusCode, resp.Status))
 	}
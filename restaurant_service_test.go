@@ -52,7 +52,7 @@ func TestRestaurantService(t *testing.T) {
 
 		t.Log("creating restaurant")
 
-		url := "/restaurants"
+		url := "/restaurants?force=true"
 		req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(rqPayloadJson))
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
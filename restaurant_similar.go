@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	similarTextWeight     = 0.6
+	similarDistanceWeight = 0.25
+	similarRatingWeight   = 0.15
+	// similarDistanceScale is the distance at which proximity drops to 1/e.
+	similarDistanceScale = 5000.0
+	similarDefaultLimit  = 5
+	similarMaxLimit      = 20
+)
+
+type (
+	// similarIndex keeps the restaurants most similar to each restaurant. Similarities are
+	// computed in the background over the whole dataset, so requests only look them up.
+	similarIndex struct {
+		sync.RWMutex
+		restaurants map[string]restaurantApi
+		ratings     map[string]float64
+		neighbors   map[string][]similarNeighbor
+		refreshedAt time.Time
+	}
+
+	similarNeighbor struct {
+		restaurantId string
+		similarity   float64
+	}
+
+	similarRestaurant struct {
+		restaurant
+		Similarity float64 `json:"similarity"`
+	}
+)
+
+var (
+	similarRefreshEvery    = 15 * time.Minute
+	restaurantSimilarities = &similarIndex{}
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_SIMILAR_REFRESH"); ok {
+		every, err := time.ParseDuration(value)
+		if err != nil || every <= 0 {
+			log.Fatalf("APP_SIMILAR_REFRESH: invalid duration '%s'", value)
+		}
+		similarRefreshEvery = every
+	}
+}
+
+// getSimilarRestaurants returns the restaurants most like the given one. It answers 503
+// until the first background refresh, and restaurants created since the last refresh
+// have no similar restaurants yet.
+func getSimilarRestaurants(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	abortIfTrashed(c, restaurantId)
+	limit := similarDefaultLimit
+	if l := c.Query("limit"); l != "" {
+		value, err := strconv.Atoi(l)
+		if err != nil || value <= 0 || value > similarMaxLimit {
+			err = fmt.Errorf("query parameter 'limit' must be between 1 and %d", similarMaxLimit)
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		limit = value
+	}
+	restaurantSimilarities.RLock()
+	refreshed := !restaurantSimilarities.refreshedAt.IsZero()
+	restaurantSimilarities.RUnlock()
+	if !refreshed {
+		err := errors.New("similar restaurants are not computed yet")
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		panic(err)
+	}
+	similar, indexed := restaurantSimilarities.similar(restaurantId, limit)
+	if !indexed {
+		requireRestaurant(c, restaurantId)
+	}
+	c.JSON(http.StatusOK, similar)
+}
+
+// similar returns the restaurants most like the given one, and whether it was indexed.
+func (s *similarIndex) similar(restaurantId string, limit int) ([]similarRestaurant, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	_, indexed := s.restaurants[restaurantId]
+	similar := []similarRestaurant{}
+	for _, neighbor := range s.neighbors[restaurantId] {
+		if len(similar) == limit {
+			break
+		}
+		if trash.contains(neighbor.restaurantId) {
+			continue
+		}
+		rest := newRestaurant(s.restaurants[neighbor.restaurantId])
+		if rating, ok := s.ratings[neighbor.restaurantId]; ok {
+			rest.Rating = &rating
+		}
+		similar = append(similar, similarRestaurant{restaurant: rest, Similarity: neighbor.similarity})
+	}
+	return similar, indexed
+}
+
+// remove drops a purged restaurant from the index and from the neighbors of the others,
+// rather than leaving it until the next refresh.
+func (s *similarIndex) remove(restaurantId string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.restaurants[restaurantId]; !ok {
+		return
+	}
+	delete(s.restaurants, restaurantId)
+	delete(s.ratings, restaurantId)
+	delete(s.neighbors, restaurantId)
+	for id, neighbors := range s.neighbors {
+		kept := make([]similarNeighbor, 0, len(neighbors))
+		for _, neighbor := range neighbors {
+			if neighbor.restaurantId != restaurantId {
+				kept = append(kept, neighbor)
+			}
+		}
+		s.neighbors[id] = kept
+	}
+}
+
+// refresh recomputes the similarities over every restaurant. The ratings come from the
+// top restaurants ranking, which already keeps them.
+func (s *similarIndex) refresh(ctx context.Context) error {
+	rests, err := GetAllRestaurants(ctx)
+	if err != nil {
+		return err
+	}
+	rests = trash.filter(rests)
+
+	topRestaurants.RLock()
+	rankingRefreshed := !topRestaurants.refreshedAt.IsZero()
+	topRestaurants.RUnlock()
+	if !rankingRefreshed {
+		if err := topRestaurants.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	rated := topRestaurants.ratingsById()
+
+	byId := make(map[string]restaurantApi, len(rests))
+	for _, rest := range rests {
+		byId[rest.Id] = rest
+	}
+	neighbors := similarities(rests, rated, similarMaxLimit)
+	s.Lock()
+	s.restaurants = byId
+	s.ratings = rated
+	s.neighbors = neighbors
+	s.refreshedAt = time.Now()
+	s.Unlock()
+	return nil
+}
+
+// run refreshes the similarities periodically until ctx is done.
+func (s *similarIndex) run(ctx context.Context) {
+	ticker := time.NewTicker(similarRefreshEvery)
+	defer ticker.Stop()
+	for {
+		if err := s.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("similar restaurants: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// similarities finds the most similar restaurants of each restaurant, scoring pairs by
+// the cosine similarity of their TF-IDF weighted descriptions, how close they are and
+// how close their ratings are. A part is left out when a restaurant lacks the data.
+func similarities(rests []restaurantApi, rated map[string]float64, limit int) map[string][]similarNeighbor {
+	type location struct {
+		lat, lng float64
+		ok       bool
+	}
+	locations := make([]location, len(rests))
+	vectors := make([]map[string]float64, len(rests))
+	documentFrequency := map[string]int{}
+	for idx, rest := range rests {
+		lat, lng, ok := restaurantCoordinates(rest)
+		locations[idx] = location{lat, lng, ok}
+		vectors[idx] = map[string]float64{}
+		for _, term := range tokenize(rest.Description) {
+			vectors[idx][term]++
+		}
+		for term := range vectors[idx] {
+			documentFrequency[term]++
+		}
+	}
+	for _, vector := range vectors {
+		norm := 0.0
+		for term, count := range vector {
+			weight := count * math.Log(float64(len(rests)+1)/float64(documentFrequency[term]))
+			vector[term] = weight
+			norm += weight * weight
+		}
+		norm = math.Sqrt(norm)
+		for term := range vector {
+			if norm > 0 {
+				vector[term] /= norm
+			}
+		}
+	}
+
+	scoreRange := float64(ratingMaxScore - ratingMinScore)
+	neighbors := make(map[string][]similarNeighbor, len(rests))
+	for i, a := range rests {
+		ratingA, ratedA := rated[a.Id]
+		var candidates []similarNeighbor
+		for j, b := range rests {
+			if i == j {
+				continue
+			}
+			text := 0.0
+			for term, weight := range vectors[i] {
+				text += weight * vectors[j][term]
+			}
+			similarity := similarTextWeight * text
+			if locations[i].ok && locations[j].ok {
+				distance := haversineMeters(locations[i].lat, locations[i].lng, locations[j].lat, locations[j].lng)
+				similarity += similarDistanceWeight * math.Exp(-distance/similarDistanceScale)
+			}
+			if ratingB, ok := rated[b.Id]; ratedA && ok && scoreRange > 0 {
+				similarity += similarRatingWeight * (1 - math.Abs(ratingA-ratingB)/scoreRange)
+			}
+			if similarity > 0 {
+				candidates = append(candidates, similarNeighbor{restaurantId: b.Id, similarity: similarity})
+			}
+		}
+		sort.SliceStable(candidates, func(x, y int) bool {
+			return candidates[x].similarity > candidates[y].similarity
+		})
+		if len(candidates) > limit {
+			candidates = candidates[:limit]
+		}
+		neighbors[a.Id] = candidates
+	}
+	return neighbors
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSimilarRestaurants(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	described := func(id, description, lat, lng string) restaurantApi {
+		return restaurantApi{Id: id, restaurantApiPost: restaurantApiPost{Name: id, Description: description}, Latitude: &lat, Longitude: &lng}
+	}
+	rests := []restaurantApi{
+		described("ramen", "Tonkotsu ramen and gyoza in a small noodle bar", "41.3874", "2.1686"),
+		described("udon", "Hand pulled udon noodle bar with tempura", "41.3880", "2.1690"),
+		described("tapas", "Traditional tapas and vermouth", "41.3874", "2.1686"),
+		described("far-noodles", "Ramen noodle bar", "40.4168", "-3.7038"),
+		{Id: "bare", restaurantApiPost: restaurantApiPost{Name: "bare"}},
+	}
+	rated := map[string]float64{"ramen": 4.5, "udon": 4.4, "tapas": 2}
+
+	test.Run("ranking", func(t *testing.T) {
+		neighbors := similarities(rests, rated, similarMaxLimit)
+		ramen := neighbors["ramen"]
+		if len(ramen) != 3 || ramen[0].restaurantId != "udon" {
+			t.Fatalf("unexpected neighbors: %+v", ramen)
+		}
+		for _, neighbor := range ramen {
+			if neighbor.restaurantId == "bare" {
+				t.Fatal("restaurant without anything in common ranked")
+			}
+		}
+		if len(neighbors["bare"]) != 0 {
+			t.Fatalf("unexpected neighbors: %+v", neighbors["bare"])
+		}
+		if limited := similarities(rests, rated, 1); len(limited["ramen"]) != 1 {
+			t.Fatalf("limit not applied: %+v", limited["ramen"])
+		}
+	})
+
+	test.Run("lookup", func(t *testing.T) {
+		index := &similarIndex{restaurants: map[string]restaurantApi{}, ratings: rated, neighbors: similarities(rests, rated, similarMaxLimit)}
+		for _, rest := range rests {
+			index.restaurants[rest.Id] = rest
+		}
+		similar, indexed := index.similar("ramen", 2)
+		if !indexed || len(similar) != 2 || similar[0].Id != "udon" || similar[0].Rating == nil || *similar[0].Rating != 4.4 {
+			t.Fatalf("unexpected similar restaurants: %+v", similar)
+		}
+		if similar, indexed := index.similar("unknown", 2); indexed || similar == nil || len(similar) != 0 {
+			t.Fatalf("unexpected similar restaurants: %+v", similar)
+		}
+	})
+
+	test.Run("remove", func(t *testing.T) {
+		index := &similarIndex{restaurants: map[string]restaurantApi{}, ratings: map[string]float64{}, neighbors: similarities(rests, rated, similarMaxLimit)}
+		for _, rest := range rests {
+			index.restaurants[rest.Id] = rest
+		}
+		for id, rating := range rated {
+			index.ratings[id] = rating
+		}
+		index.remove("udon")
+		if _, indexed := index.similar("udon", 2); indexed {
+			t.Fatal("removed restaurant still indexed")
+		}
+		similar, _ := index.similar("ramen", similarMaxLimit)
+		for _, rest := range similar {
+			if rest.Id == "udon" {
+				t.Fatalf("removed restaurant still a neighbor: %+v", similar)
+			}
+		}
+		if len(similar) != 2 {
+			t.Fatalf("unexpected similar restaurants: %+v", similar)
+		}
+	})
+
+	test.Run("not-refreshed", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/1/similar"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected 503, got %d", url, w.Code)
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/1/similar?limit=1000"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", url, w.Code)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const slugRoutePrefix = "/restaurants/by-slug/"
+
+// reservedSlugs can't be handed out, as gin would route /restaurants/by-slug/<slug> to
+// the fixed sub-resource of that name instead.
+var reservedSlugs = map[string]bool{
+	"images":  true,
+	"reviews": true,
+	"similar": true,
+	"tags":    true,
+}
+
+type (
+	// slugStore maps human-friendly slugs to restaurant ids. Slugs left behind by a
+	// rename stay in the store so old links can be redirected.
+	slugStore struct {
+		sync.Mutex
+		path         string
+		slugs        map[string]*slugEntry
+		byRestaurant map[string]string
+	}
+
+	slugEntry struct {
+		RestaurantId string `json:"restaurantId"`
+		Base         string `json:"base"`
+		Current      bool   `json:"current"`
+	}
+)
+
+var slugs *slugStore
+
+func newSlugStore(path string) (*slugStore, error) {
+	store := &slugStore{path: path, slugs: map[string]*slugEntry{}, byRestaurant: map[string]string{}}
+	if err := readJsonFile(path, &store.slugs); err != nil {
+		return nil, err
+	}
+	for slug, entry := range store.slugs {
+		if entry.Current {
+			store.byRestaurant[entry.RestaurantId] = slug
+		}
+	}
+	return store, nil
+}
+
+func getRestaurantBySlug(c *gin.Context) {
+	slug := strings.TrimPrefix(c.Request.URL.Path, slugRoutePrefix)
+	restaurantId, current, ok := slugs.resolve(slug)
+	if !ok {
+		err := errors.New("unknown restaurant slug")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if current != slug {
+		location := slugRoutePrefix + current
+		if c.Request.URL.RawQuery != "" {
+			location += "?" + c.Request.URL.RawQuery
+		}
+		c.Redirect(http.StatusMovedPermanently, location)
+		return
+	}
+	c.Params = append(c.Params, gin.Param{Key: "restaurantId", Value: restaurantId})
+	getRestaurantById(c)
+}
+
+func slugify(name string) string {
+	slug := strings.Join(tokenize(name), "-")
+	if slug == "" {
+		return "restaurant"
+	}
+	return slug
+}
+
+// assign returns the current slug of a restaurant, giving it a new one when it has
+// none yet or when it was renamed.
+func (s *slugStore) assign(r restaurantApi) string {
+	if r.Id == "" {
+		return ""
+	}
+	base := slugify(r.Name)
+	s.Lock()
+	defer s.Unlock()
+	current, ok := s.byRestaurant[r.Id]
+	if ok && s.slugs[current].Base == base {
+		return current
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		entry, taken := s.slugs[slug]
+		if !reservedSlugs[slug] && (!taken || entry.RestaurantId == r.Id) {
+			break
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	if ok {
+		s.slugs[current].Current = false
+	}
+	s.slugs[slug] = &slugEntry{RestaurantId: r.Id, Base: base, Current: true}
+	s.byRestaurant[r.Id] = slug
+	if err := writeJsonFile(s.path, s.slugs); err != nil {
+		log.Printf("slug store: %v", err)
+	}
+	return slug
+}
+
+// resolve returns the restaurant a slug belongs to and the restaurant's current slug.
+func (s *slugStore) resolve(slug string) (string, string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.slugs[slug]
+	if !ok {
+		return "", "", false
+	}
+	current, ok := s.byRestaurant[entry.RestaurantId]
+	if !ok {
+		return "", "", false
+	}
+	return entry.RestaurantId, current, true
+}
+
+// remove forgets every slug of a deleted restaurant.
+func (s *slugStore) remove(restaurantId string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.byRestaurant[restaurantId]; !ok {
+		return
+	}
+	for slug, entry := range s.slugs {
+		if entry.RestaurantId == restaurantId {
+			delete(s.slugs, slug)
+		}
+	}
+	delete(s.byRestaurant, restaurantId)
+	if err := writeJsonFile(s.path, s.slugs); err != nil {
+		log.Printf("slug store: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestaurantSlugs(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("slugify", func(t *testing.T) {
+		if slug := slugify("Joe's Pizza & Grill"); slug != "joes-pizza-grill" {
+			t.Fatalf("unexpected slug: %s", slug)
+		}
+		if slug := slugify("!!!"); slug != "restaurant" {
+			t.Fatalf("unexpected slug: %s", slug)
+		}
+	})
+
+	test.Run("store", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "slugs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "slugs.json")
+
+		store, err := newSlugStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := restaurantApi{Id: "1", restaurantApiPost: restaurantApiPost{Name: "Sushi Bar"}}
+		second := restaurantApi{Id: "2", restaurantApiPost: restaurantApiPost{Name: "Sushi Bar"}}
+		if slug := store.assign(first); slug != "sushi-bar" {
+			t.Fatalf("unexpected slug: %s", slug)
+		}
+		if slug := store.assign(second); slug != "sushi-bar-2" {
+			t.Fatalf("expected a suffix for the taken slug, got %s", slug)
+		}
+		if slug := store.assign(restaurantApi{Id: "3", restaurantApiPost: restaurantApiPost{Name: "Images"}}); slug != "images-2" {
+			t.Fatalf("reserved slug handed out: %s", slug)
+		}
+
+		first.Name = "Sushi Palace"
+		if slug := store.assign(first); slug != "sushi-palace" {
+			t.Fatalf("unexpected slug after rename: %s", slug)
+		}
+		reloaded, err := newSlugStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, current, ok := reloaded.resolve("sushi-bar"); !ok || id != "1" || current != "sushi-palace" {
+			t.Fatalf("old slug not kept: %s %s %v", id, current, ok)
+		}
+
+		reloaded.remove("1")
+		if _, _, ok := reloaded.resolve("sushi-bar"); ok {
+			t.Fatal("slug of a removed restaurant still resolves")
+		}
+		if _, _, ok := reloaded.resolve("sushi-bar-2"); !ok {
+			t.Fatal("slug of another restaurant removed")
+		}
+	})
+
+	test.Run("unknown", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/by-slug/no-such-restaurant"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const tagMaxPerRestaurant = 20
+
+type (
+	// tagStore keeps the tags of each restaurant, which the restaurant service has no
+	// place for. Only tags of the vocabulary are stored, in their canonical form.
+	tagStore struct {
+		sync.Mutex
+		path string
+		tags map[string][]string
+	}
+
+	// tagVocabulary maps every accepted tag and synonym to its canonical tag.
+	tagVocabulary struct {
+		tags      map[string][]string
+		canonical map[string]string
+	}
+
+	tagsPut struct {
+		Tags []string `json:"tags"`
+	}
+)
+
+var (
+	tags *tagStore
+	// defaultTagVocabulary lists the canonical tags with their synonyms, unless
+	// APP_TAG_VOCABULARY_FILE points to a JSON file of the same shape.
+	defaultTagVocabulary = map[string][]string{
+		"bakery":      {},
+		"burgers":     {"burger", "hamburger"},
+		"cafe":        {"coffee", "coffee-shop"},
+		"chinese":     {},
+		"desserts":    {"dessert", "sweets"},
+		"french":      {"bistro", "brasserie"},
+		"gluten-free": {"celiac", "coeliac"},
+		"halal":       {},
+		"indian":      {},
+		"italian":     {"trattoria", "osteria"},
+		"japanese":    {},
+		"kosher":      {},
+		"mexican":     {"taqueria"},
+		"pizza":       {"pizzeria"},
+		"seafood":     {"fish"},
+		"spanish":     {"tapas"},
+		"steakhouse":  {"steak", "grill"},
+		"sushi":       {},
+		"thai":        {},
+		"vegan":       {"plant-based"},
+		"vegetarian":  {"veggie"},
+	}
+	tagsVocabulary *tagVocabulary
+)
+
+func init() {
+	definitions := defaultTagVocabulary
+	if value, ok := os.LookupEnv("APP_TAG_VOCABULARY_FILE"); ok {
+		definitions = nil
+		if err := readJsonFile(value, &definitions); err != nil || definitions == nil {
+			log.Fatalf("APP_TAG_VOCABULARY_FILE: invalid vocabulary '%s': %v", value, err)
+		}
+	}
+	vocabulary, err := newTagVocabulary(definitions)
+	if err != nil {
+		log.Fatalf("tag vocabulary: %v", err)
+	}
+	tagsVocabulary = vocabulary
+}
+
+func newTagVocabulary(definitions map[string][]string) (*tagVocabulary, error) {
+	vocabulary := &tagVocabulary{tags: map[string][]string{}, canonical: map[string]string{}}
+	for tag, synonyms := range definitions {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			return nil, errors.New("empty tag")
+		}
+		vocabulary.tags[tag] = []string{}
+		for _, name := range append([]string{tag}, synonyms...) {
+			name = normalizeTag(name)
+			if other, ok := vocabulary.canonical[name]; ok && other != tag {
+				return nil, fmt.Errorf("'%s' names both '%s' and '%s'", name, other, tag)
+			}
+			vocabulary.canonical[name] = tag
+			if name != tag {
+				vocabulary.tags[tag] = append(vocabulary.tags[tag], name)
+			}
+		}
+	}
+	return vocabulary, nil
+}
+
+func newTagStore(path string) (*tagStore, error) {
+	store := &tagStore{path: path, tags: map[string][]string{}}
+	if err := readJsonFile(path, &store.tags); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func addTagEndpoints(r *gin.Engine) {
+	r.GET("/tags", getTagVocabulary)
+	r.PUT("/restaurants/:restaurantId/tags", putRestaurantTags)
+}
+
+func getTagVocabulary(c *gin.Context) {
+	c.JSON(http.StatusOK, tagsVocabulary.tags)
+}
+
+// putRestaurantTags replaces the tags of a restaurant. Synonyms are stored as their
+// canonical tag, and an empty list removes every tag.
+func putRestaurantTags(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	var rq tagsPut
+	if err := c.BindJSON(&rq); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if rq.Tags == nil {
+		err := errors.New("missing tags")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	canonical, err := tagsVocabulary.resolve(rq.Tags)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if len(canonical) > tagMaxPerRestaurant {
+		err := fmt.Errorf("a restaurant can have up to %d tags", tagMaxPerRestaurant)
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	requireRestaurant(c, restaurantId)
+	if err := tags.set(restaurantId, canonical); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	events.publish(eventRestaurantUpdated, restaurantId, gin.H{"tags": canonical})
+	c.JSON(http.StatusOK, tagsPut{Tags: canonical})
+}
+
+// normalizeTag lowercases a tag and joins its words with dashes, so "Plant based" and
+// "plant-based" are the same tag.
+func normalizeTag(tag string) string {
+	return strings.Join(tokenize(tag), "-")
+}
+
+// resolve maps tags and synonyms to their canonical tags, sorted and without
+// duplicates. Tags outside the vocabulary are an error.
+func (v *tagVocabulary) resolve(names []string) ([]string, error) {
+	seen := map[string]bool{}
+	resolved := []string{}
+	var unknown []string
+	for _, name := range names {
+		tag, ok := v.canonical[normalizeTag(name)]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			resolved = append(resolved, tag)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown tags: %s", strings.Join(unknown, ", "))
+	}
+	sort.Strings(resolved)
+	return resolved, nil
+}
+
+// of returns the tags of a restaurant, never nil so they show up as an empty list.
+func (s *tagStore) of(restaurantId string) []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.tags[restaurantId]...)
+}
+
+func (s *tagStore) set(restaurantId string, restaurantTags []string) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(restaurantTags) == 0 {
+		if _, ok := s.tags[restaurantId]; !ok {
+			return nil
+		}
+		delete(s.tags, restaurantId)
+	} else {
+		s.tags[restaurantId] = restaurantTags
+	}
+	return writeJsonFile(s.path, s.tags)
+}
+
+// filter keeps the restaurants that have every one of the tags.
+func (s *tagStore) filter(r []restaurantApi, required []string) []restaurantApi {
+	s.Lock()
+	defer s.Unlock()
+	kept := make([]restaurantApi, 0, len(r))
+	for _, item := range r {
+		has := map[string]bool{}
+		for _, tag := range s.tags[item.Id] {
+			has[tag] = true
+		}
+		matches := true
+		for _, tag := range required {
+			if !has[tag] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func (s *tagStore) remove(restaurantId string) {
+	if err := s.set(restaurantId, nil); err != nil {
+		log.Printf("tag store: %v", err)
+	}
+}
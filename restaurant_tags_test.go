@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRestaurantTags(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("vocabulary", func(t *testing.T) {
+		vocabulary, err := newTagVocabulary(map[string][]string{"Italian": {"Trattoria"}, "vegan": {"plant based"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := vocabulary.resolve([]string{"trattoria", "Plant-Based", "italian"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resolved, []string{"italian", "vegan"}) {
+			t.Fatalf("unexpected tags: %v", resolved)
+		}
+		if _, err := vocabulary.resolve([]string{"italian", "pasta"}); err == nil {
+			t.Fatal("unknown tag accepted")
+		}
+		if _, err := newTagVocabulary(map[string][]string{"grill": {}, "steakhouse": {"grill"}}); err == nil {
+			t.Fatal("ambiguous synonym accepted")
+		}
+	})
+
+	test.Run("list", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/tags", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var listed map[string][]string
+		if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) == 0 || !reflect.DeepEqual(listed, tagsVocabulary.tags) {
+			t.Fatalf("unexpected vocabulary: %v", listed)
+		}
+	})
+
+	test.Run("store", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "tags")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "tags.json")
+
+		store, err := newTagStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.set("1", []string{"italian", "pizza"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.set("2", []string{"pizza"}); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := newTagStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rests := []restaurantApi{{Id: "1"}, {Id: "2"}, {Id: "3"}}
+		if kept := reloaded.filter(rests, []string{"pizza"}); len(kept) != 2 {
+			t.Fatalf("unexpected restaurants: %+v", kept)
+		}
+		if kept := reloaded.filter(rests, []string{"pizza", "italian"}); len(kept) != 1 || kept[0].Id != "1" {
+			t.Fatalf("unexpected restaurants: %+v", kept)
+		}
+		reloaded.remove("1")
+		if restaurantTags := reloaded.of("1"); restaurantTags == nil || len(restaurantTags) != 0 {
+			t.Fatalf("tags of a removed restaurant kept: %v", restaurantTags)
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/1/tags"
+		req, _ := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBufferString(`{"tags": ["not-a-cuisine"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", url, w.Code)
+		}
+
+		url = "/restaurants?tag=not-a-cuisine"
+		req, _ = http.NewRequestWithContext(ctx, "GET", url, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", url, w.Code)
+		}
+	})
+
+	test.Run("unknown-restaurant", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/00000000-0000-0000-0000-000000000000/tags"
+		req, _ := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBufferString(`{"tags": ["vegan"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", url, w.Code)
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	topDefaultLimit      = 10
+	topMaxLimit          = 100
+	topDefaultRadius     = 5000.0
+	topLookupConcurrency = 8
+)
+
+type (
+	// topRanking caches the ratings of every restaurant, refreshed in the background, so
+	// the ranking can be scored and filtered per request without hitting the services.
+	topRanking struct {
+		sync.RWMutex
+		entries     []topEntry
+		refreshedAt time.Time
+	}
+
+	topEntry struct {
+		restaurant restaurantApi
+		rating     float64
+		votes      int
+	}
+
+	// topQuery holds the priors and filters of a ranking request. The prior mean is the
+	// mean rating of all rated restaurants unless configured.
+	topQuery struct {
+		priorMean   *float64
+		priorWeight float64
+		name        []string
+		near        bool
+		lat, lng    float64
+		radius      float64
+		limit       int
+	}
+
+	rankedRestaurant struct {
+		restaurant
+		Votes          int      `json:"votes"`
+		Score          float64  `json:"score"`
+		DistanceMeters *float64 `json:"distanceMeters,omitempty"`
+	}
+)
+
+var (
+	topPriorMean    *float64
+	topPriorWeight  = 10.0
+	topRefreshEvery = 5 * time.Minute
+	topRestaurants  = &topRanking{}
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_TOP_PRIOR_MEAN"); ok {
+		mean, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("APP_TOP_PRIOR_MEAN: %v", err)
+		}
+		topPriorMean = &mean
+	}
+	if value, ok := os.LookupEnv("APP_TOP_PRIOR_WEIGHT"); ok {
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight < 0 {
+			log.Fatalf("APP_TOP_PRIOR_WEIGHT: invalid weight '%s'", value)
+		}
+		topPriorWeight = weight
+	}
+	if value, ok := os.LookupEnv("APP_TOP_REFRESH"); ok {
+		every, err := time.ParseDuration(value)
+		if err != nil || every <= 0 {
+			log.Fatalf("APP_TOP_REFRESH: invalid duration '%s'", value)
+		}
+		topRefreshEvery = every
+	}
+}
+
+func getTopRestaurants(c *gin.Context) {
+	query, err := parseTopQuery(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	topRestaurants.RLock()
+	refreshed := !topRestaurants.refreshedAt.IsZero()
+	topRestaurants.RUnlock()
+	if !refreshed {
+		if err := topRestaurants.refresh(c.Request.Context()); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			panic(err)
+		}
+	}
+	c.JSON(http.StatusOK, topRestaurants.rank(query))
+}
+
+func parseTopQuery(c *gin.Context) (topQuery, error) {
+	query := topQuery{priorMean: topPriorMean, priorWeight: topPriorWeight, radius: topDefaultRadius, limit: topDefaultLimit}
+	parseFloat := func(key string) (*float64, error) {
+		q := c.Query(key)
+		if q == "" {
+			return nil, nil
+		}
+		value, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, fmt.Errorf("query parameter '%s' must be a number", key)
+		}
+		return &value, nil
+	}
+
+	if mean, err := parseFloat("priorMean"); err != nil {
+		return query, err
+	} else if mean != nil {
+		query.priorMean = mean
+	}
+	if weight, err := parseFloat("priorWeight"); err != nil {
+		return query, err
+	} else if weight != nil {
+		if *weight < 0 {
+			return query, errors.New("query parameter 'priorWeight' must not be negative")
+		}
+		query.priorWeight = *weight
+	}
+	query.name = tokenize(c.Query("name"))
+
+	lat, err := parseFloat("lat")
+	if err != nil {
+		return query, err
+	}
+	lng, err := parseFloat("lng")
+	if err != nil {
+		return query, err
+	}
+	if (lat == nil) != (lng == nil) {
+		return query, errors.New("query parameters 'lat' and 'lng' must be given together")
+	}
+	if lat != nil {
+		if *lat < -90 || *lat > 90 || *lng < -180 || *lng > 180 {
+			return query, errors.New("query parameters 'lat' and 'lng' are out of range")
+		}
+		query.near, query.lat, query.lng = true, *lat, *lng
+	}
+	if radius, err := parseFloat("radius"); err != nil {
+		return query, err
+	} else if radius != nil {
+		if *radius <= 0 {
+			return query, errors.New("query parameter 'radius' must be positive")
+		}
+		query.radius = *radius
+	}
+
+	if l := c.Query("limit"); l != "" {
+		value, err := strconv.Atoi(l)
+		if err != nil || value <= 0 || value > topMaxLimit {
+			return query, fmt.Errorf("query parameter 'limit' must be between 1 and %d", topMaxLimit)
+		}
+		query.limit = value
+	}
+	return query, nil
+}
+
+// rank scores the rated restaurants with a Bayesian average, which pulls the rating of
+// restaurants with few votes towards the prior mean:
+// (priorWeight * priorMean + votes * rating) / (priorWeight + votes)
+// Restaurants without votes score the prior mean whatever their rating; they still
+// count towards the default prior mean.
+func (t *topRanking) rank(query topQuery) []rankedRestaurant {
+	t.RLock()
+	defer t.RUnlock()
+
+	priorMean := 0.0
+	if query.priorMean != nil {
+		priorMean = *query.priorMean
+	} else if len(t.entries) > 0 {
+		for _, entry := range t.entries {
+			priorMean += entry.rating
+		}
+		priorMean /= float64(len(t.entries))
+	}
+
+	ranked := []rankedRestaurant{}
+	for _, entry := range t.entries {
+		if !entry.matchesName(query.name) {
+			continue
+		}
+		var distance *float64
+		if query.near {
+			lat, lng, ok := restaurantCoordinates(entry.restaurant)
+			if !ok {
+				continue
+			}
+			d := haversineMeters(query.lat, query.lng, lat, lng)
+			if d > query.radius {
+				continue
+			}
+			distance = &d
+		}
+		rating := entry.rating
+		votes := float64(entry.votes)
+		score := priorMean
+		if query.priorWeight+votes > 0 {
+			score = (query.priorWeight*priorMean + votes*rating) / (query.priorWeight + votes)
+		}
+		rest := newRestaurant(entry.restaurant)
+		rest.Rating = &rating
+		ranked = append(ranked, rankedRestaurant{restaurant: rest, Votes: entry.votes, Score: score, DistanceMeters: distance})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Votes > ranked[j].Votes
+	})
+	if len(ranked) > query.limit {
+		ranked = ranked[:query.limit]
+	}
+	return ranked
+}
+
+// matchesName tells whether every query token starts a word of the restaurant name.
+func (e topEntry) matchesName(tokens []string) bool {
+	words := tokenize(e.restaurant.Name)
+	for _, token := range tokens {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, token) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// refresh looks up the rating of every restaurant and swaps the cached ranking. The
+// rating service doesn't report vote counts, so they come from the ledger, where the
+// ratings a restaurant got before the gateway saw its votes weigh ratingUpstreamVotes.
+func (t *topRanking) refresh(ctx context.Context) error {
+	rests, err := GetAllRestaurants(ctx)
+	if err != nil {
+		return err
+	}
+	rests = trash.filter(rests)
+
+	entries := make([]*topEntry, len(rests))
+	sem := make(chan struct{}, topLookupConcurrency)
+	var wg sync.WaitGroup
+	for idx := range rests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			upstream, err := GetRatingByRestaurantId(ctx, rests[idx].Id)
+			if err != nil {
+				return
+			}
+			rating, votes := ratings.reconcile(rests[idx].Id, upstream)
+			if rating == nil {
+				return
+			}
+			entries[idx] = &topEntry{restaurant: rests[idx], rating: *rating, votes: votes}
+		}(idx)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	rated := make([]topEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry != nil {
+			rated = append(rated, *entry)
+		}
+	}
+	t.Lock()
+	t.entries = rated
+	t.refreshedAt = time.Now()
+	t.Unlock()
+	return nil
+}
+
+// remove drops a purged restaurant from the ranking until the next refresh.
+func (t *topRanking) remove(restaurantId string) {
+	t.Lock()
+	defer t.Unlock()
+	kept := make([]topEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		if entry.restaurant.Id != restaurantId {
+			kept = append(kept, entry)
+		}
+	}
+	t.entries = kept
+}
+
+// ratingsById returns the cached rating of every rated restaurant.
+func (t *topRanking) ratingsById() map[string]float64 {
+	t.RLock()
+	defer t.RUnlock()
+	rated := make(map[string]float64, len(t.entries))
+	for _, entry := range t.entries {
+		rated[entry.restaurant.Id] = entry.rating
+	}
+	return rated
+}
+
+// run refreshes the ranking periodically until ctx is done.
+func (t *topRanking) run(ctx context.Context) {
+	ticker := time.NewTicker(topRefreshEvery)
+	defer ticker.Stop()
+	for {
+		if err := t.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("top restaurants: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
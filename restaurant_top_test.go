@@ -0,0 +1,113 @@
+package main
+
+import (
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTopRestaurants(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	located := func(id, name, lat, lng string) restaurantApi {
+		return restaurantApi{Id: id, restaurantApiPost: restaurantApiPost{Name: name}, Latitude: &lat, Longitude: &lng}
+	}
+	ranking := &topRanking{entries: []topEntry{
+		{restaurant: located("1", "Lucky Star", "41.3874", "2.1686"), rating: 5, votes: 1},
+		{restaurant: located("2", "Crowd Favourite", "41.3880", "2.1690"), rating: 4.8, votes: 400},
+		{restaurant: located("3", "Far Away Diner", "40.4168", "-3.7038"), rating: 4.9, votes: 100},
+		{restaurant: restaurantApi{Id: "4", restaurantApiPost: restaurantApiPost{Name: "Lucky Noodles"}}, rating: 2, votes: 50},
+	}}
+	mean := 3.5
+	query := topQuery{priorMean: &mean, priorWeight: 10, radius: topDefaultRadius, limit: topDefaultLimit}
+
+	test.Run("bayesian", func(t *testing.T) {
+		ranked := ranking.rank(query)
+		if len(ranked) != 4 || ranked[0].Id != "3" || ranked[1].Id != "2" || ranked[3].Id != "4" {
+			t.Fatalf("unexpected ranking: %+v", ranked)
+		}
+		if ranked[2].Id != "1" || ranked[2].Score >= 4 {
+			t.Fatalf("a single vote was not pulled to the prior: %+v", ranked[2])
+		}
+	})
+
+	test.Run("cold-start", func(t *testing.T) {
+		// ratings from before the ledger weigh ratingUpstreamVotes votes
+		dir, err := ioutil.TempDir("", "top")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ledger, err := newRatingLedger(filepath.Join(dir, "ratings.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := func(id string, upstream float64) topEntry {
+			rating, votes := ledger.reconcile(id, &upstream)
+			return topEntry{restaurant: restaurantApi{Id: id}, rating: *rating, votes: votes}
+		}
+		cold := &topRanking{entries: []topEntry{
+			entry("legacy-high", 5),
+			entry("legacy-low", 1),
+			{restaurant: restaurantApi{Id: "unvoted"}, rating: 4},
+		}}
+		ranked := cold.rank(topQuery{priorWeight: 10, radius: topDefaultRadius, limit: topDefaultLimit})
+		if len(ranked) != 3 || ranked[0].Id != "legacy-high" || ranked[2].Id != "legacy-low" {
+			t.Fatalf("legacy ratings not ranked: %+v", ranked)
+		}
+		if ranked[0].Votes != ratingUpstreamVotes {
+			t.Fatalf("legacy rating without votes: %+v", ranked[0])
+		}
+		priorMean := (5.0 + 1 + 4) / 3
+		if ranked[1].Score != priorMean {
+			t.Fatalf("restaurant without votes not scored at the prior mean %v: %+v", priorMean, ranked[1])
+		}
+	})
+
+	test.Run("filters", func(t *testing.T) {
+		near := query
+		near.near, near.lat, near.lng = true, 41.3874, 2.1686
+		if ranked := ranking.rank(near); len(ranked) != 2 || ranked[0].Id != "2" || ranked[0].DistanceMeters == nil {
+			t.Fatalf("unexpected nearby ranking: %+v", ranked)
+		}
+		named := query
+		named.name = tokenize("luck")
+		if ranked := ranking.rank(named); len(ranked) != 2 || ranked[0].Id != "1" {
+			t.Fatalf("unexpected named ranking: %+v", ranked)
+		}
+		limited := query
+		limited.limit = 1
+		if ranked := ranking.rank(limited); len(ranked) != 1 {
+			t.Fatalf("limit not applied: %+v", ranked)
+		}
+	})
+
+	test.Run("remove", func(t *testing.T) {
+		removed := &topRanking{entries: append([]topEntry{}, ranking.entries...)}
+		removed.remove("2")
+		for _, item := range removed.rank(query) {
+			if item.Id == "2" {
+				t.Fatalf("removed restaurant still ranked: %+v", item)
+			}
+		}
+		if len(removed.entries) != len(ranking.entries)-1 {
+			t.Fatalf("unexpected entries: %+v", removed.entries)
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		for _, url := range []string{"/restaurants/top?lat=41.3", "/restaurants/top?limit=1000", "/restaurants/top?priorWeight=-1"} {
+			req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%s: expected 400, got %d", url, w.Code)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// restaurantTrash keeps the tombstones of soft-deleted restaurants until their
+	// retention period is over and they are deleted for good.
+	restaurantTrash struct {
+		sync.Mutex
+		path       string
+		tombstones map[string]*restaurantTombstone
+	}
+
+	restaurantTombstone struct {
+		Restaurant restaurantApi `json:"restaurant"`
+		DeletedAt  time.Time     `json:"deletedAt"`
+		PurgeAt    time.Time     `json:"purgeAt"`
+	}
+)
+
+var (
+	softDeleteRetention time.Duration
+	trash               *restaurantTrash
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_SOFT_DELETE_RETENTION"); ok {
+		retention, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("APP_SOFT_DELETE_RETENTION: %v", err)
+		}
+		softDeleteRetention = retention
+	}
+}
+
+func newRestaurantTrash(path string) (*restaurantTrash, error) {
+	t := &restaurantTrash{path: path, tombstones: map[string]*restaurantTombstone{}}
+	if err := readJsonFile(path, &t.tombstones); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func softDeleteEnabled() bool {
+	return softDeleteRetention > 0
+}
+
+func getRestaurantTrash(c *gin.Context) {
+	c.JSON(http.StatusOK, trash.list())
+}
+
+func restoreRestaurant(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+
+	tombstone, err := trash.remove(restaurantId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if tombstone == nil {
+		err := errors.New("restaurant is not in the trash")
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	restaurantSearch.put(tombstone.Restaurant)
+	events.publish(eventRestaurantRestored, restaurantId, newRestaurant(tombstone.Restaurant))
+	c.JSON(http.StatusOK, tombstone.Restaurant)
+}
+
+func (t *restaurantTrash) add(r restaurantApi) error {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	t.tombstones[r.Id] = &restaurantTombstone{Restaurant: r, DeletedAt: now, PurgeAt: now.Add(softDeleteRetention)}
+	return writeJsonFile(t.path, t.tombstones)
+}
+
+func (t *restaurantTrash) remove(restaurantId string) (*restaurantTombstone, error) {
+	t.Lock()
+	defer t.Unlock()
+	tombstone, ok := t.tombstones[restaurantId]
+	if !ok {
+		return nil, nil
+	}
+	delete(t.tombstones, restaurantId)
+	return tombstone, writeJsonFile(t.path, t.tombstones)
+}
+
+func (t *restaurantTrash) contains(restaurantId string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.tombstones[restaurantId]
+	return ok
+}
+
+// filter drops the restaurants that are in the trash from a listing.
+func (t *restaurantTrash) filter(rests []restaurantApi) []restaurantApi {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.tombstones) == 0 {
+		return rests
+	}
+	visible := make([]restaurantApi, 0, len(rests))
+	for _, r := range rests {
+		if _, ok := t.tombstones[r.Id]; !ok {
+			visible = append(visible, r)
+		}
+	}
+	return visible
+}
+
+func (t *restaurantTrash) list() []restaurantTombstone {
+	t.Lock()
+	defer t.Unlock()
+	tombstones := make([]restaurantTombstone, 0, len(t.tombstones))
+	for _, tombstone := range t.tombstones {
+		tombstones = append(tombstones, *tombstone)
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		return tombstones[i].DeletedAt.After(tombstones[j].DeletedAt)
+	})
+	return tombstones
+}
+
+// run deletes the restaurants whose retention period is over until ctx is done.
+func (t *restaurantTrash) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		t.purge(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *restaurantTrash) purge(ctx context.Context) {
+	t.Lock()
+	var due []string
+	now := time.Now()
+	for restaurantId, tombstone := range t.tombstones {
+		if !tombstone.PurgeAt.After(now) {
+			due = append(due, restaurantId)
+		}
+	}
+	t.Unlock()
+
+	for _, restaurantId := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := t.purgeRestaurant(ctx, restaurantId); err != nil {
+			log.Printf("restaurant trash: purging %s: %v", restaurantId, err)
+		}
+	}
+}
+
+func (t *restaurantTrash) purgeRestaurant(ctx context.Context, restaurantId string) error {
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	if !t.contains(restaurantId) {
+		// restored in the meantime
+		return nil
+	}
+	// a restaurant the restaurant service no longer has is as good as purged
+	if err := DeleteRestaurantById(ctx, restaurantId); err != nil && err != errRestaurantNotFound {
+		return err
+	}
+	if err := imageCleanup.deleteRestaurantImages(ctx, restaurantId); err != nil {
+		return err
+	}
+	forgetRestaurant(restaurantId)
+	_, err := t.remove(restaurantId)
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestaurantTrash(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("tombstones", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "trash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "trash.json")
+
+		bin, err := newRestaurantTrash(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bin.add(benchdata); err != nil {
+			t.Fatal(err)
+		}
+		other := benchdata
+		other.Id = "other"
+		if visible := bin.filter([]restaurantApi{benchdata, other}); len(visible) != 1 || visible[0].Id != "other" {
+			t.Fatalf("trashed restaurant still listed: %v", visible)
+		}
+
+		reloaded, err := newRestaurantTrash(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reloaded.contains(benchdata.Id) {
+			t.Fatal("tombstone not persisted")
+		}
+		tombstone, err := reloaded.remove(benchdata.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tombstone == nil || tombstone.Restaurant.Name != benchdata.Name || reloaded.contains(benchdata.Id) {
+			t.Fatalf("unexpected restore result: %v", tombstone)
+		}
+	})
+
+	test.Run("list", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/trash"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+		var tombstones []restaurantTombstone
+		if err := json.NewDecoder(res.Body).Decode(&tombstones); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	test.Run("restore-missing", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/restaurants/not-in-trash/restore"
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
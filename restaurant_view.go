@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+const (
+	includeImages = "images"
+	includeRating = "rating"
+)
+
+var restaurantFields = []string{"id", "name", "description", "latitude", "longitude", "slug", "rating", "reviewCount", "tags", "images"}
+
+// restaurantView describes which downstream lookups a restaurant response needs and
+// which of its fields are sent back, as requested with ?fields= and ?include=.
+type restaurantView struct {
+	fields map[string]bool
+	images bool
+	rating bool
+}
+
+func parseRestaurantView(c *gin.Context) (restaurantView, error) {
+	view := restaurantView{images: true, rating: true}
+
+	if q := c.Query("fields"); q != "" {
+		known := map[string]bool{}
+		for _, field := range restaurantFields {
+			known[field] = true
+		}
+		view.fields = map[string]bool{}
+		for _, field := range splitQueryList(q) {
+			if !known[field] {
+				return view, fmt.Errorf("unknown field '%s'", field)
+			}
+			view.fields[field] = true
+		}
+		view.images = view.fields[includeImages]
+		view.rating = view.fields[includeRating]
+	}
+
+	if q, ok := c.GetQuery("include"); ok {
+		view.images = false
+		view.rating = false
+		for _, item := range splitQueryList(q) {
+			switch item {
+			case includeImages:
+				view.images = true
+			case includeRating:
+				view.rating = true
+			default:
+				return view, fmt.Errorf("unknown include '%s'", item)
+			}
+		}
+	}
+	return view, nil
+}
+
+// render trims a restaurant down to the requested fields, leaving out the embeds whose
+// lookups were skipped so they don't show up as empty values.
+func (v restaurantView) render(rest restaurant) (interface{}, error) {
+	if v.fields == nil && v.images && v.rating {
+		return rest, nil
+	}
+	data, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for key := range values {
+		if (v.fields != nil && !v.fields[key]) || (key == includeImages && !v.images) || (key == includeRating && !v.rating) {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+func (v restaurantView) renderAll(rests []restaurant) (interface{}, error) {
+	if v.fields == nil && v.images && v.rating {
+		return rests, nil
+	}
+	values := make([]interface{}, 0, len(rests))
+	for _, rest := range rests {
+		value, err := v.render(rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func splitQueryList(q string) []string {
+	var items []string
+	for _, item := range strings.Split(q, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.undefinedlabs.com/scopeagent"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRestaurantView(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	parse := func(t *testing.T, url string) restaurantView {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", url, nil)
+		view, err := parseRestaurantView(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return view
+	}
+	rating := 4.5
+	rest := restaurant{
+		restaurantApi: restaurantApi{Id: "1", restaurantApiPost: restaurantApiPost{Name: "TestName", Description: "TestDescription"}},
+		Rating:        &rating,
+		Images:        []string{"/images/1"},
+	}
+
+	test.Run("default", func(t *testing.T) {
+		view := parse(t, "/restaurants")
+		if !view.images || !view.rating {
+			t.Fatal("all lookups expected by default")
+		}
+	})
+
+	test.Run("fields", func(t *testing.T) {
+		view := parse(t, "/restaurants?fields=id,name,rating")
+		if view.images || !view.rating {
+			t.Fatalf("unexpected lookups: %+v", view)
+		}
+		body, err := view.render(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(body)
+		if string(data) != `{"id":"1","name":"TestName","rating":4.5}` {
+			t.Fatalf("unexpected body: %s", data)
+		}
+	})
+
+	test.Run("include", func(t *testing.T) {
+		view := parse(t, "/restaurants?include=images")
+		if !view.images || view.rating {
+			t.Fatalf("unexpected lookups: %+v", view)
+		}
+		body, err := view.render(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := body.(map[string]json.RawMessage)["rating"]; ok {
+			t.Fatal("skipped rating must not be rendered")
+		}
+	})
+
+	test.Run("unknown", func(t *testing.T) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/restaurants?fields=id,owner", nil)
+		if _, err := parseRestaurantView(c); err == nil {
+			t.Fatal("expected an error for an unknown field")
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reviewMaxTextLength   = 5000
+	reviewMaxAuthorLength = 100
+	reviewDefaultLimit    = 20
+	reviewMaxLimit        = 100
+)
+
+type (
+	// reviewStore keeps the written reviews, which the rating service has no place for.
+	// The score of a review is submitted as the author's rating.
+	reviewStore struct {
+		sync.Mutex
+		path    string
+		reviews map[string][]*review
+	}
+
+	review struct {
+		Id           string       `json:"id"`
+		RestaurantId string       `json:"restaurantId"`
+		Author       reviewAuthor `json:"author"`
+		Score        int          `json:"score"`
+		Text         string       `json:"text"`
+		CreatedAt    time.Time    `json:"createdAt"`
+		UpdatedAt    *time.Time   `json:"updatedAt,omitempty"`
+	}
+
+	reviewAuthor struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	reviewPost struct {
+		Score      *int    `json:"score"`
+		Text       *string `json:"text"`
+		AuthorName *string `json:"authorName"`
+	}
+
+	// reviewPosted is a review as answered to its author, telling whether its score was
+	// held back for review by the rating guard.
+	reviewPosted struct {
+		review
+		RatingQuarantined bool `json:"ratingQuarantined,omitempty"`
+	}
+
+	reviewPage struct {
+		Reviews    []review `json:"reviews"`
+		Total      int      `json:"total"`
+		NextOffset *int     `json:"nextOffset"`
+	}
+)
+
+var (
+	reviews           *reviewStore
+	errReviewNotFound = errors.New("review not found")
+)
+
+func newReviewStore(path string) (*reviewStore, error) {
+	store := &reviewStore{path: path, reviews: map[string][]*review{}}
+	if err := readJsonFile(path, &store.reviews); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func addReviewEndpoints(r *gin.Engine) {
+	r.GET("/restaurants/:restaurantId/reviews", getReviews)
+	r.POST("/restaurants/:restaurantId/reviews", idempotencyMiddleware, postReview)
+	r.PATCH("/restaurants/:restaurantId/reviews/:reviewId", patchReview)
+	r.DELETE("/restaurants/:restaurantId/reviews/:reviewId", deleteReview)
+}
+
+func getReviews(c *gin.Context) {
+	offset, limit := 0, reviewDefaultLimit
+	if q := c.Query("offset"); q != "" {
+		value, err := strconv.Atoi(q)
+		if err != nil || value < 0 {
+			err = errors.New("query parameter 'offset' must be a non-negative integer")
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		offset = value
+	}
+	if q := c.Query("limit"); q != "" {
+		value, err := strconv.Atoi(q)
+		if err != nil || value <= 0 || value > reviewMaxLimit {
+			err = fmt.Errorf("query parameter 'limit' must be between 1 and %d", reviewMaxLimit)
+			c.AbortWithError(http.StatusBadRequest, err)
+			panic(err)
+		}
+		limit = value
+	}
+	c.JSON(http.StatusOK, reviews.page(c.Param("restaurantId"), offset, limit))
+}
+
+func postReview(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	author := reviewAuthorOf(c)
+	var rq reviewPost
+	if err := c.BindJSON(&rq); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if rq.Score == nil || rq.Text == nil {
+		err := errors.New("a review needs a score and a text")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if rq.AuthorName != nil {
+		author.Name = strings.TrimSpace(*rq.AuthorName)
+	}
+	rv := review{Id: newId(), RestaurantId: restaurantId, Author: author, Score: *rq.Score, Text: strings.TrimSpace(*rq.Text)}
+	if err := rv.validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	requireRestaurant(c, restaurantId)
+
+	// the author's rating and review go in together, a concurrent post of theirs waits
+	// and finds the review
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	if existing, ok := reviews.byAuthor(restaurantId, author.Id); ok {
+		err := fmt.Errorf("review %s already exists, edit it instead", existing.Id)
+		c.AbortWithError(http.StatusConflict, err)
+		panic(err)
+	}
+	_, quarantined := submitRating(c, restaurantId, "user:"+author.Id, ratingPost{Score: rq.Score})
+	rv.CreatedAt = time.Now().UTC()
+	if err := reviews.add(rv); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if quarantined {
+		c.JSON(http.StatusAccepted, reviewPosted{review: rv, RatingQuarantined: true})
+		return
+	}
+	c.JSON(http.StatusCreated, reviewPosted{review: rv})
+}
+
+func patchReview(c *gin.Context) {
+	restaurantId := c.Param("restaurantId")
+	author := reviewAuthorOf(c)
+	var rq reviewPost
+	if err := c.BindJSON(&rq); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	unlock := lockRestaurant(restaurantId)
+	defer unlock()
+	rv := findOwnReview(c, author)
+	if rq.Text != nil {
+		rv.Text = strings.TrimSpace(*rq.Text)
+	}
+	if rq.AuthorName != nil {
+		rv.Author.Name = strings.TrimSpace(*rq.AuthorName)
+	}
+	scoreChanged := rq.Score != nil && *rq.Score != rv.Score
+	if rq.Score != nil {
+		rv.Score = *rq.Score
+	}
+	if err := rv.validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	quarantined := false
+	if scoreChanged {
+		_, quarantined = submitRating(c, restaurantId, "user:"+author.Id, ratingPost{Score: rq.Score})
+	}
+	now := time.Now().UTC()
+	rv.UpdatedAt = &now
+	if err := reviews.update(rv); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	if quarantined {
+		c.JSON(http.StatusAccepted, reviewPosted{review: rv, RatingQuarantined: true})
+		return
+	}
+	c.JSON(http.StatusOK, reviewPosted{review: rv})
+}
+
+// deleteReview removes the text of a review, the author's rating stays until it is
+// withdrawn through DELETE /rating/:restaurantId.
+func deleteReview(c *gin.Context) {
+	author := reviewAuthorOf(c)
+	rv := findOwnReview(c, author)
+	if err := reviews.remove(rv.RestaurantId, rv.Id); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// reviewAuthorOf identifies the author of a review, named after their user id unless
+// they give a name.
+func reviewAuthorOf(c *gin.Context) reviewAuthor {
+	userId := signedInUser(c)
+	return reviewAuthor{Id: userId, Name: userId}
+}
+
+func findOwnReview(c *gin.Context, author reviewAuthor) review {
+	rv, ok := reviews.get(c.Param("restaurantId"), c.Param("reviewId"))
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, errReviewNotFound)
+		panic(errReviewNotFound)
+	}
+	if rv.Author.Id != author.Id {
+		err := errors.New("only the author can change a review")
+		c.AbortWithError(http.StatusForbidden, err)
+		panic(err)
+	}
+	return rv
+}
+
+func (rv review) validate() error {
+	if err := (ratingPost{Score: &rv.Score}).validate(); err != nil {
+		return err
+	}
+	if rv.Text == "" {
+		return errors.New("empty review text")
+	}
+	if len([]rune(rv.Text)) > reviewMaxTextLength {
+		return fmt.Errorf("review text is longer than %d characters", reviewMaxTextLength)
+	}
+	if rv.Author.Name == "" || len([]rune(rv.Author.Name)) > reviewMaxAuthorLength {
+		return fmt.Errorf("author name must have between 1 and %d characters", reviewMaxAuthorLength)
+	}
+	return nil
+}
+
+func (s *reviewStore) add(rv review) error {
+	s.Lock()
+	defer s.Unlock()
+	s.reviews[rv.RestaurantId] = append(s.reviews[rv.RestaurantId], &rv)
+	return writeJsonFile(s.path, s.reviews)
+}
+
+func (s *reviewStore) update(rv review) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range s.reviews[rv.RestaurantId] {
+		if item.Id == rv.Id {
+			*item = rv
+			return writeJsonFile(s.path, s.reviews)
+		}
+	}
+	return errReviewNotFound
+}
+
+func (s *reviewStore) remove(restaurantId string, reviewId string) error {
+	s.Lock()
+	defer s.Unlock()
+	items := s.reviews[restaurantId]
+	for idx, item := range items {
+		if item.Id == reviewId {
+			s.reviews[restaurantId] = append(items[:idx], items[idx+1:]...)
+			if len(s.reviews[restaurantId]) == 0 {
+				delete(s.reviews, restaurantId)
+			}
+			return writeJsonFile(s.path, s.reviews)
+		}
+	}
+	return errReviewNotFound
+}
+
+// removeRestaurant forgets every review of a deleted restaurant.
+func (s *reviewStore) removeRestaurant(restaurantId string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.reviews[restaurantId]; !ok {
+		return
+	}
+	delete(s.reviews, restaurantId)
+	if err := writeJsonFile(s.path, s.reviews); err != nil {
+		log.Printf("review store: %v", err)
+	}
+}
+
+func (s *reviewStore) get(restaurantId string, reviewId string) (review, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range s.reviews[restaurantId] {
+		if item.Id == reviewId {
+			return *item, true
+		}
+	}
+	return review{}, false
+}
+
+func (s *reviewStore) byAuthor(restaurantId string, authorId string) (review, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range s.reviews[restaurantId] {
+		if item.Author.Id == authorId {
+			return *item, true
+		}
+	}
+	return review{}, false
+}
+
+func (s *reviewStore) count(restaurantId string) int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.reviews[restaurantId])
+}
+
+// page returns the reviews of a restaurant, newest first.
+func (s *reviewStore) page(restaurantId string, offset int, limit int) reviewPage {
+	s.Lock()
+	defer s.Unlock()
+	items := s.reviews[restaurantId]
+	page := reviewPage{Reviews: []review{}, Total: len(items)}
+	for idx := len(items) - 1 - offset; idx >= 0 && len(page.Reviews) < limit; idx-- {
+		page.Reviews = append(page.Reviews, *items[idx])
+	}
+	if next := offset + len(page.Reviews); next < len(items) {
+		page.NextOffset = &next
+	}
+	return page
+}
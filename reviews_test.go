@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReviews(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("store", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "reviews")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "reviews.json")
+
+		store, err := newReviewStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			author := reviewAuthor{Id: fmt.Sprintf("user-%d", i), Name: "Someone"}
+			if err := store.add(review{Id: fmt.Sprintf("r%d", i), RestaurantId: "1", Author: author, Score: 4, Text: "Good"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reloaded, err := newReviewStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := reloaded.page("1", 0, 2)
+		if page.Total != 5 || len(page.Reviews) != 2 || page.Reviews[0].Id != "r4" || page.NextOffset == nil || *page.NextOffset != 2 {
+			t.Fatalf("unexpected first page: %+v", page)
+		}
+		if page := reloaded.page("1", 4, 2); len(page.Reviews) != 1 || page.Reviews[0].Id != "r0" || page.NextOffset != nil {
+			t.Fatalf("unexpected last page: %+v", page)
+		}
+
+		rv, ok := reloaded.byAuthor("1", "user-2")
+		if !ok {
+			t.Fatal("review not found by author")
+		}
+		rv.Text = "Even better"
+		if err := reloaded.update(rv); err != nil {
+			t.Fatal(err)
+		}
+		if rv, _ := reloaded.get("1", rv.Id); rv.Text != "Even better" {
+			t.Fatalf("review not updated: %+v", rv)
+		}
+		if err := reloaded.remove("1", rv.Id); err != nil {
+			t.Fatal(err)
+		}
+		if reloaded.count("1") != 4 {
+			t.Fatalf("unexpected count: %d", reloaded.count("1"))
+		}
+		reloaded.removeRestaurant("1")
+		if reloaded.count("1") != 0 {
+			t.Fatal("reviews of a removed restaurant kept")
+		}
+	})
+
+	test.Run("validation", func(t *testing.T) {
+		author := reviewAuthor{Id: "user", Name: "User"}
+		for _, rv := range []review{
+			{Author: author, Score: 0, Text: "Bad score"},
+			{Author: author, Score: 3, Text: ""},
+			{Author: author, Score: 3, Text: strings.Repeat("a", reviewMaxTextLength+1)},
+			{Author: reviewAuthor{Id: "user"}, Score: 3, Text: "No name"},
+		} {
+			if err := rv.validate(); err == nil {
+				t.Fatalf("invalid review accepted: %+v", rv)
+			}
+		}
+	})
+
+	test.Run("owner", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		restaurantId := "reviews-test-" + newId()
+		defer reviews.removeRestaurant(restaurantId)
+		rv := review{Id: newId(), RestaurantId: restaurantId, Author: reviewAuthor{Id: "author", Name: "Author"}, Score: 5, Text: "Great", CreatedAt: time.Now()}
+		if err := reviews.add(rv); err != nil {
+			t.Fatal(err)
+		}
+
+		url := fmt.Sprintf("/restaurants/%s/reviews/%s", restaurantId, rv.Id)
+		req, _ := http.NewRequestWithContext(ctx, "PATCH", url, strings.NewReader(`{"text":"Not mine"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+userToken("someone-else"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", w.Code)
+		}
+
+		req, _ = http.NewRequestWithContext(ctx, "PATCH", url, strings.NewReader(`{"text":"Still great"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+userToken("author"))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+
+		url = fmt.Sprintf("/restaurants/%s/reviews", restaurantId)
+		req, _ = http.NewRequestWithContext(ctx, "GET", url, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page reviewPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 1 || page.Reviews[0].Text != "Still great" || page.Reviews[0].UpdatedAt == nil {
+			t.Fatalf("unexpected reviews: %+v", page)
+		}
+	})
+
+	test.Run("quarantined", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		defer ratingGuards.unflag(restaurantId)
+		ratingGuards.Lock()
+		ratingGuards.flags[restaurantId] = time.Now().Add(time.Hour)
+		ratingGuards.Unlock()
+
+		url := fmt.Sprintf("/restaurants/%s/reviews", restaurantId)
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(`{"score":5,"text":"Best ever"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+userToken("reviews-test-quarantined"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", w.Code)
+		}
+		var posted reviewPosted
+		if err := json.NewDecoder(w.Body).Decode(&posted); err != nil {
+			t.Fatal(err)
+		}
+		defer reviews.remove(restaurantId, posted.Id)
+		if !posted.RatingQuarantined || posted.Text != "Best ever" {
+			t.Fatalf("unexpected review: %+v", posted)
+		}
+		for _, vote := range ratingGuards.quarantined() {
+			if vote.RestaurantId == restaurantId {
+				ratingGuards.release(vote.Id)
+			}
+		}
+	})
+
+	test.Run("anonymous", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := fmt.Sprintf("/restaurants/%s/reviews", restaurantId)
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(`{"score":4,"text":"Nice"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", w.Code)
+		}
+	})
+}
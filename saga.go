@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"github.com/opentracing/opentracing-go"
+	"time"
+)
+
+const (
+	sagaStepSucceeded          = "succeeded"
+	sagaStepFailed             = "failed"
+	sagaStepCompensated        = "compensated"
+	sagaStepCompensationFailed = "compensationFailed"
+)
+
+type (
+	// saga runs a sequence of downstream calls and remembers how to undo each of them,
+	// so a failure half way through can be rolled back.
+	saga struct {
+		Steps         []*sagaStep `json:"steps"`
+		compensations []sagaCompensation
+	}
+
+	sagaStep struct {
+		Name              string `json:"name"`
+		Status            string `json:"status"`
+		Error             string `json:"error,omitempty"`
+		CompensationError string `json:"compensationError,omitempty"`
+	}
+
+	sagaCompensation struct {
+		step       *sagaStep
+		compensate func(ctx context.Context) error
+	}
+)
+
+func (s *saga) run(ctx context.Context, name string, action func(ctx context.Context) error, compensate func(ctx context.Context) error) error {
+	step := &sagaStep{Name: name, Status: sagaStepSucceeded}
+	s.Steps = append(s.Steps, step)
+	if err := action(ctx); err != nil {
+		step.Status = sagaStepFailed
+		step.Error = err.Error()
+		return err
+	}
+	if compensate != nil {
+		s.compensations = append(s.compensations, sagaCompensation{step: step, compensate: compensate})
+	}
+	return nil
+}
+
+// compensate undoes the succeeded steps in reverse order. It keeps going when a
+// compensation fails and reports whether all of them succeeded.
+func (s *saga) compensate(ctx context.Context) bool {
+	// the rollback must finish even when the client has already gone away
+	ctx, cancel := context.WithTimeout(detachedContext(ctx), 30*time.Second)
+	defer cancel()
+	ok := true
+	for idx := len(s.compensations) - 1; idx >= 0; idx-- {
+		compensation := s.compensations[idx]
+		if err := compensation.compensate(ctx); err != nil {
+			compensation.step.Status = sagaStepCompensationFailed
+			compensation.step.CompensationError = err.Error()
+			ok = false
+		} else {
+			compensation.step.Status = sagaStepCompensated
+		}
+	}
+	s.compensations = nil
+	return ok
+}
+
+// detachedContext keeps the tracing span of ctx but not its cancellation or deadline.
+func detachedContext(ctx context.Context) context.Context {
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		return opentracing.ContextWithSpan(context.Background(), sp)
+	}
+	return context.Background()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.undefinedlabs.com/scopeagent"
+	"testing"
+)
+
+func TestSaga(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("compensate", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		var undone []string
+		succeed := func(ctx context.Context) error { return nil }
+		undo := func(name string, err error) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				undone = append(undone, name)
+				return err
+			}
+		}
+
+		var tx saga
+		tx.run(ctx, "restaurant.create", succeed, undo("restaurant", nil))
+		tx.run(ctx, "image[0].upload", succeed, undo("image0", errors.New("image service down")))
+		err := tx.run(ctx, "image[1].upload", func(ctx context.Context) error { return errors.New("upload failed") }, undo("image1", nil))
+		if err == nil {
+			t.Fatal("expected the failing step to return its error")
+		}
+		if tx.compensate(ctx) {
+			t.Fatal("expected a failed compensation to be reported")
+		}
+
+		if len(undone) != 2 || undone[0] != "image0" || undone[1] != "restaurant" {
+			t.Fatalf("unexpected compensation order: %v", undone)
+		}
+		expected := []string{sagaStepCompensated, sagaStepCompensationFailed, sagaStepFailed}
+		for idx, step := range tx.Steps {
+			if step.Status != expected[idx] {
+				t.Fatalf("step %s: expected %s, got %s", step.Name, expected[idx], step.Status)
+			}
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// userTokenSecret verifies the tokens of signed in users: HS256 JSON web tokens issued
+// by the identity provider, whose "sub" claim is the user id. Signing in is disabled
+// when no secret is configured.
+var userTokenSecret = ""
+
+var (
+	errInvalidUserToken = errors.New("invalid user token")
+	errExpiredUserToken = errors.New("user token expired")
+)
+
+func init() {
+	if secret, ok := os.LookupEnv("APP_USER_TOKEN_SECRET"); ok {
+		userTokenSecret = secret
+	}
+}
+
+// signedInUser returns the id of the user making the request, aborting with 401 unless
+// the request carries a valid user token.
+func signedInUser(c *gin.Context) string {
+	if userTokenSecret == "" {
+		err := errors.New("user sign in is disabled")
+		c.AbortWithError(http.StatusUnauthorized, err)
+		panic(err)
+	}
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		err := errors.New("missing user token")
+		c.AbortWithError(http.StatusUnauthorized, err)
+		panic(err)
+	}
+	userId, err := verifyUserToken(strings.TrimPrefix(header, "Bearer "), time.Now())
+	if err != nil {
+		c.AbortWithError(http.StatusUnauthorized, err)
+		panic(err)
+	}
+	return userId
+}
+
+// verifyUserToken checks the signature and validity period of a user token and returns
+// its subject. Tokens without an expiry are rejected.
+func verifyUserToken(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidUserToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", errInvalidUserToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, signUserToken(parts[0]+"."+parts[1])) {
+		return "", errInvalidUserToken
+	}
+	var claims struct {
+		Subject   string   `json:"sub"`
+		ExpiresAt *float64 `json:"exp"`
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil || strings.TrimSpace(claims.Subject) == "" {
+		return "", errInvalidUserToken
+	}
+	if claims.ExpiresAt == nil || float64(now.Unix()) >= *claims.ExpiresAt {
+		return "", errExpiredUserToken
+	}
+	if claims.NotBefore != nil && float64(now.Unix()) < *claims.NotBefore {
+		return "", errInvalidUserToken
+	}
+	return claims.Subject, nil
+}
+
+func signUserToken(content string) []byte {
+	mac := hmac.New(sha256.New, []byte(userTokenSecret))
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"go.undefinedlabs.com/scopeagent"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userToken signs a token for userId that expires in an hour.
+func userToken(userId string) string {
+	return signTestToken(map[string]interface{}{"sub": userId, "exp": time.Now().Add(time.Hour).Unix()})
+}
+
+func signTestToken(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	content := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return content + "." + base64.RawURLEncoding.EncodeToString(signUserToken(content))
+}
+
+func TestUserAuth(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	test.Run("valid", func(t *testing.T) {
+		userId, err := verifyUserToken(userToken("user-1"), time.Now())
+		if err != nil || userId != "user-1" {
+			t.Fatalf("unexpected result: %q, %v", userId, err)
+		}
+	})
+
+	test.Run("invalid", func(t *testing.T) {
+		now := time.Now()
+		valid := userToken("user-1")
+		parts := strings.Split(valid, ".")
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "." + parts[2]
+		for name, token := range map[string]string{
+			"malformed": "not-a-token",
+			"tampered":  valid[:len(valid)-2] + "xx",
+			"alg-none":  none,
+			"expired":   signTestToken(map[string]interface{}{"sub": "user-1", "exp": now.Add(-time.Minute).Unix()}),
+			"no-expiry": signTestToken(map[string]interface{}{"sub": "user-1"}),
+			"no-sub":    signTestToken(map[string]interface{}{"exp": now.Add(time.Hour).Unix()}),
+			"not-yet":   signTestToken(map[string]interface{}{"sub": "user-1", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Minute).Unix()}),
+		} {
+			if userId, err := verifyUserToken(token, now); err == nil {
+				t.Fatalf("%s: token accepted for %q", name, userId)
+			}
+		}
+	})
+}
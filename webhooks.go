@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+
+	webhookDeliveryHistory = 50
+)
+
+type (
+	webhook struct {
+		Id        string    `json:"id"`
+		Url       string    `json:"url"`
+		Events    []string  `json:"events"`
+		Secret    string    `json:"secret,omitempty"`
+		Active    bool      `json:"active"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	webhookRequest struct {
+		Url    *string   `json:"url"`
+		Events *[]string `json:"events"`
+		Secret *string   `json:"secret"`
+		Active *bool     `json:"active"`
+	}
+
+	webhookDelivery struct {
+		Id          string           `json:"id"`
+		WebhookId   string           `json:"webhookId"`
+		Event       event            `json:"event"`
+		Status      string           `json:"status"`
+		Attempts    []webhookAttempt `json:"attempts"`
+		CreatedAt   time.Time        `json:"createdAt"`
+		NextAttempt time.Time        `json:"nextAttempt"`
+	}
+
+	webhookAttempt struct {
+		At         time.Time `json:"at"`
+		StatusCode int       `json:"statusCode,omitempty"`
+		Error      string    `json:"error,omitempty"`
+		DurationMs int64     `json:"durationMs"`
+	}
+
+	// webhookStore keeps the webhook subscriptions and their deliveries in a file, so
+	// pending deliveries survive a restart. Deliveries that ran out of attempts stay
+	// in the store as dead letters until they are retried or the webhook is deleted.
+	webhookStore struct {
+		sync.Mutex
+		path string
+		webhookState
+		wake chan struct{}
+	}
+
+	webhookState struct {
+		Webhooks   []*webhook         `json:"webhooks"`
+		Deliveries []*webhookDelivery `json:"deliveries"`
+	}
+)
+
+// webhookEvents are the events partners can subscribe to.
+var webhookEvents = map[string]bool{
+	eventRestaurantCreated:  true,
+	eventRestaurantUpdated:  true,
+	eventRestaurantDeleted:  true,
+	eventRestaurantRestored: true,
+	eventRatingAdded:        true,
+	eventRatingUpdated:      true,
+	eventRatingDeleted:      true,
+}
+
+var (
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookTimeout     = 10 * time.Second
+	webhooks           *webhookStore
+	errWebhookNotFound = errors.New("webhook not found")
+)
+
+func init() {
+	if value, ok := os.LookupEnv("APP_WEBHOOK_MAX_ATTEMPTS"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			log.Fatalf("APP_WEBHOOK_MAX_ATTEMPTS: invalid value '%s'", value)
+		}
+		webhookMaxAttempts = n
+	}
+}
+
+func newWebhookStore(path string) (*webhookStore, error) {
+	store := &webhookStore{path: path, wake: make(chan struct{}, 1)}
+	if err := readJsonFile(path, &store.webhookState); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func addWebhookEndpoints(r *gin.Engine) {
+	g := r.Group("/webhooks", adminAuthMiddleware)
+	g.GET("", getWebhooks)
+	g.POST("", postWebhook)
+	g.GET("/:webhookId", getWebhook)
+	g.PATCH("/:webhookId", patchWebhook)
+	g.DELETE("/:webhookId", deleteWebhook)
+	g.GET("/:webhookId/deliveries", getWebhookDeliveries)
+	g.GET("/:webhookId/dead-letters", getWebhookDeadLetters)
+	g.POST("/:webhookId/deliveries/:deliveryId/retry", retryWebhookDelivery)
+}
+
+func getWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, webhooks.list())
+}
+
+func getWebhook(c *gin.Context) {
+	c.JSON(http.StatusOK, findWebhook(c))
+}
+
+func postWebhook(c *gin.Context) {
+	var rq webhookRequest
+	if err := c.BindJSON(&rq); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if rq.Url == nil {
+		err := errors.New("missing webhook url")
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	hook := webhook{Id: newId(), Secret: newId(), Active: true, CreatedAt: time.Now()}
+	if err := rq.apply(&hook); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	if err := webhooks.add(hook); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	// the secret is only ever sent back here
+	c.JSON(http.StatusCreated, hook)
+}
+
+func patchWebhook(c *gin.Context) {
+	var rq webhookRequest
+	if err := c.BindJSON(&rq); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	hook, err := webhooks.update(c.Param("webhookId"), rq.apply)
+	if err == errWebhookNotFound {
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		panic(err)
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+func deleteWebhook(c *gin.Context) {
+	err := webhooks.remove(c.Param("webhookId"))
+	if err == errWebhookNotFound {
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		panic(err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func getWebhookDeliveries(c *gin.Context) {
+	hook := findWebhook(c)
+	c.JSON(http.StatusOK, webhooks.deliveries(hook.Id, c.Query("status")))
+}
+
+func getWebhookDeadLetters(c *gin.Context) {
+	hook := findWebhook(c)
+	c.JSON(http.StatusOK, webhooks.deliveries(hook.Id, webhookDead))
+}
+
+func retryWebhookDelivery(c *gin.Context) {
+	if err := webhooks.retryNow(c.Param("webhookId"), c.Param("deliveryId")); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		panic(err)
+	}
+	c.Status(http.StatusAccepted)
+}
+
+func findWebhook(c *gin.Context) webhook {
+	hook, ok := webhooks.get(c.Param("webhookId"))
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, errWebhookNotFound)
+		panic(errWebhookNotFound)
+	}
+	return hook
+}
+
+func (rq webhookRequest) apply(hook *webhook) error {
+	if rq.Url != nil {
+		u, err := url.Parse(*rq.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url '%s'", *rq.Url)
+		}
+		hook.Url = *rq.Url
+	}
+	if rq.Events != nil {
+		for _, eventType := range *rq.Events {
+			if !webhookEvents[eventType] {
+				return fmt.Errorf("unknown webhook event '%s'", eventType)
+			}
+		}
+		hook.Events = *rq.Events
+	}
+	if rq.Secret != nil {
+		if *rq.Secret == "" {
+			return errors.New("empty webhook secret")
+		}
+		hook.Secret = *rq.Secret
+	}
+	if rq.Active != nil {
+		hook.Active = *rq.Active
+	}
+	return nil
+}
+
+// wants tells whether a webhook is subscribed to an event. A webhook without events
+// gets all of them.
+func (w webhook) wants(eventType string) bool {
+	if !w.Active || !webhookEvents[eventType] {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, item := range w.Events {
+		if item == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhookPayload signs the timestamp and the body of a delivery with the webhook
+// secret, so receivers can check both where it comes from and that it isn't replayed.
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *webhookStore) save() error {
+	return writeJsonFile(s.path, s.webhookState)
+}
+
+func (s *webhookStore) list() []webhook {
+	s.Lock()
+	defer s.Unlock()
+	hooks := make([]webhook, 0, len(s.Webhooks))
+	for _, hook := range s.Webhooks {
+		hidden := *hook
+		hidden.Secret = ""
+		hooks = append(hooks, hidden)
+	}
+	return hooks
+}
+
+func (s *webhookStore) get(webhookId string) (webhook, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, hook := range s.Webhooks {
+		if hook.Id == webhookId {
+			hidden := *hook
+			hidden.Secret = ""
+			return hidden, true
+		}
+	}
+	return webhook{}, false
+}
+
+func (s *webhookStore) add(hook webhook) error {
+	s.Lock()
+	defer s.Unlock()
+	s.Webhooks = append(s.Webhooks, &hook)
+	return s.save()
+}
+
+func (s *webhookStore) update(webhookId string, apply func(*webhook) error) (webhook, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, hook := range s.Webhooks {
+		if hook.Id != webhookId {
+			continue
+		}
+		updated := *hook
+		if err := apply(&updated); err != nil {
+			return webhook{}, err
+		}
+		*hook = updated
+		updated.Secret = ""
+		return updated, s.save()
+	}
+	return webhook{}, errWebhookNotFound
+}
+
+// remove deletes a webhook together with its pending deliveries and dead letters.
+func (s *webhookStore) remove(webhookId string) error {
+	s.Lock()
+	defer s.Unlock()
+	for idx, hook := range s.Webhooks {
+		if hook.Id != webhookId {
+			continue
+		}
+		s.Webhooks = append(s.Webhooks[:idx], s.Webhooks[idx+1:]...)
+		var deliveries []*webhookDelivery
+		for _, delivery := range s.Deliveries {
+			if delivery.WebhookId != webhookId {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		s.Deliveries = deliveries
+		return s.save()
+	}
+	return errWebhookNotFound
+}
+
+// deliveries returns the deliveries of a webhook, newest first, optionally only the
+// ones with the given status.
+func (s *webhookStore) deliveries(webhookId string, status string) []webhookDelivery {
+	s.Lock()
+	defer s.Unlock()
+	deliveries := []webhookDelivery{}
+	for idx := len(s.Deliveries) - 1; idx >= 0; idx-- {
+		delivery := s.Deliveries[idx]
+		if delivery.WebhookId == webhookId && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	return deliveries
+}
+
+// enqueue records a delivery of the event for every webhook subscribed to it.
+func (s *webhookStore) enqueue(e event) {
+	s.Lock()
+	defer s.Unlock()
+	queued := false
+	for _, hook := range s.Webhooks {
+		if hook.wants(e.Type) {
+			now := time.Now()
+			s.Deliveries = append(s.Deliveries, &webhookDelivery{
+				Id:          newId(),
+				WebhookId:   hook.Id,
+				Event:       e,
+				Status:      webhookPending,
+				CreatedAt:   now,
+				NextAttempt: now,
+			})
+			queued = true
+		}
+	}
+	if !queued {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("webhook store: %v", err)
+	}
+	s.notify()
+}
+
+func (s *webhookStore) retryNow(webhookId string, deliveryId string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, delivery := range s.Deliveries {
+		if delivery.Id == deliveryId && delivery.WebhookId == webhookId {
+			delivery.Status = webhookPending
+			delivery.NextAttempt = time.Now()
+			s.notify()
+			return s.save()
+		}
+	}
+	return errors.New("webhook delivery not found")
+}
+
+func (s *webhookStore) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the due deliveries until ctx is done.
+func (s *webhookStore) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookBaseBackoff)
+	defer ticker.Stop()
+	for {
+		s.process(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *webhookStore) process(ctx context.Context) {
+	type dueDelivery struct {
+		delivery webhookDelivery
+		hook     webhook
+	}
+	s.Lock()
+	var due []dueDelivery
+	now := time.Now()
+	for _, delivery := range s.Deliveries {
+		if delivery.Status != webhookPending || delivery.NextAttempt.After(now) {
+			continue
+		}
+		for _, hook := range s.Webhooks {
+			if hook.Id == delivery.WebhookId {
+				due = append(due, dueDelivery{*delivery, *hook})
+			}
+		}
+	}
+	s.Unlock()
+
+	for _, item := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		attempt := deliverWebhook(ctx, item.hook, item.delivery)
+		if err := s.complete(item.delivery.Id, attempt); err != nil {
+			log.Printf("webhook store: %v", err)
+		}
+	}
+}
+
+func deliverWebhook(ctx context.Context, hook webhook, delivery webhookDelivery) (attempt webhookAttempt) {
+	attempt.At = time.Now()
+	defer func() {
+		attempt.DurationMs = time.Since(attempt.At).Milliseconds()
+	}()
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", hook.Id)
+	req.Header.Set("X-Webhook-Delivery", delivery.Id)
+	req.Header.Set("X-Webhook-Event", delivery.Event.Type)
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(hook.Secret, attempt.At.Unix(), body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("webhook responded %s", resp.Status)
+	}
+	return attempt
+}
+
+// complete records an attempt: the delivery is done when it succeeded, rescheduled with
+// a longer backoff when it didn't, and dead once it is out of attempts.
+func (s *webhookStore) complete(deliveryId string, attempt webhookAttempt) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, delivery := range s.Deliveries {
+		if delivery.Id != deliveryId {
+			continue
+		}
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		switch {
+		case attempt.Error == "":
+			delivery.Status = webhookDelivered
+		case len(delivery.Attempts) >= webhookMaxAttempts:
+			delivery.Status = webhookDead
+		default:
+			delivery.NextAttempt = time.Now().Add(retryBackoff(webhookBaseBackoff, webhookMaxBackoff, len(delivery.Attempts)))
+		}
+		break
+	}
+	s.prune()
+	return s.save()
+}
+
+// prune forgets the oldest delivered deliveries of every webhook beyond its history.
+func (s *webhookStore) prune() {
+	delivered := map[string]int{}
+	var deliveries []*webhookDelivery
+	for idx := len(s.Deliveries) - 1; idx >= 0; idx-- {
+		delivery := s.Deliveries[idx]
+		if delivery.Status == webhookDelivered {
+			delivered[delivery.WebhookId]++
+			if delivered[delivery.WebhookId] > webhookDeliveryHistory {
+				continue
+			}
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	s.Deliveries = deliveries
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"go.undefinedlabs.com/scopeagent"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebhooks(t *testing.T) {
+	test := scopeagent.GetTest(t)
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	test.Run("delivery", func(t *testing.T) {
+		failures := 1
+		var signature, body string
+		partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			signature, body = r.Header.Get("X-Webhook-Signature"), string(data)
+		}))
+		defer partner.Close()
+
+		store, err := newWebhookStore(filepath.Join(dir, "delivery.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hook := webhook{Id: "hook", Url: partner.URL, Secret: "secret", Events: []string{eventRestaurantDeleted}, Active: true}
+		if err := store.add(hook); err != nil {
+			t.Fatal(err)
+		}
+		store.enqueue(event{Id: 1, Type: eventRestaurantCreated, RestaurantId: "1"})
+		store.enqueue(event{Id: 2, Type: eventRestaurantDeleted, RestaurantId: "1"})
+
+		store.process(context.Background())
+		deliveries := store.deliveries("hook", "")
+		if len(deliveries) != 1 || deliveries[0].Status != webhookPending || len(deliveries[0].Attempts) != 1 || deliveries[0].Attempts[0].StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("failed attempt not recorded: %+v", deliveries)
+		}
+
+		if err := store.retryNow("hook", deliveries[0].Id); err != nil {
+			t.Fatal(err)
+		}
+		store.process(context.Background())
+		if deliveries := store.deliveries("hook", webhookDelivered); len(deliveries) != 1 || len(deliveries[0].Attempts) != 2 {
+			t.Fatalf("delivery not completed: %+v", store.deliveries("hook", ""))
+		}
+		attempt := store.deliveries("hook", "")[0].Attempts[1]
+		if expected := signWebhookPayload("secret", attempt.At.Unix(), []byte(body)); signature != expected {
+			t.Fatalf("unexpected signature %s, expected %s", signature, expected)
+		}
+	})
+
+	test.Run("dead-letter", func(t *testing.T) {
+		partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer partner.Close()
+
+		path := filepath.Join(dir, "dead-letter.json")
+		store, err := newWebhookStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.add(webhook{Id: "hook", Url: partner.URL, Secret: "secret", Active: true}); err != nil {
+			t.Fatal(err)
+		}
+		store.enqueue(event{Id: 1, Type: eventRatingAdded, RestaurantId: "1"})
+		for attempts := 0; attempts < webhookMaxAttempts; attempts++ {
+			for _, delivery := range store.deliveries("hook", webhookPending) {
+				store.retryNow("hook", delivery.Id)
+			}
+			store.process(context.Background())
+		}
+
+		reloaded, err := newWebhookStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dead := reloaded.deliveries("hook", webhookDead); len(dead) != 1 || len(dead[0].Attempts) != webhookMaxAttempts {
+			t.Fatalf("delivery not dead-lettered: %+v", reloaded.deliveries("hook", ""))
+		}
+		if err := reloaded.remove("hook"); err != nil {
+			t.Fatal(err)
+		}
+		if deliveries := reloaded.deliveries("hook", ""); len(deliveries) != 0 {
+			t.Fatalf("deliveries of a removed webhook kept: %+v", deliveries)
+		}
+	})
+
+	test.Run("validation", func(t *testing.T) {
+		var hook webhook
+		for _, rq := range []webhookRequest{
+			{Url: stringPtr("ftp://example.com")},
+			{Events: &[]string{"image.added"}},
+			{Secret: stringPtr("")},
+		} {
+			if err := rq.apply(&hook); err == nil {
+				t.Fatalf("invalid request accepted: %+v", rq)
+			}
+		}
+	})
+
+	test.Run("admin-disabled", func(t *testing.T) {
+		ctx := scopeagent.GetContextFromTest(t)
+		url := "/webhooks"
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("server: %s respond: %d: %s", url, res.StatusCode, res.Status)
+		}
+	})
+}
+
+func stringPtr(s string) *string {
+	return &s
+}